@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
+)
+
+const (
+	MethodGSSAPI byte = 0x01
+
+	// payload carried by one encapsulated message, leaving room for the
+	// mechanism's wrap overhead inside the 64K token limit
+	maxGSSAPIPayload = 32 * 1024
+)
+
+var (
+	ERR_GSSAPI_PROTECTION = errors.New("gssapi protection level not acceptable")
+)
+
+// GSSAPIMechanism is the security mechanism behind the GSSAPI method, e.g.
+// a Kerberos provider. One instance serves one session.
+type GSSAPIMechanism interface {
+	// AcceptSecContext consumes a context token from the client and returns
+	// the token to send back, done reports the context is established.
+	AcceptSecContext(token []byte) (output []byte, done bool, err error)
+	// Wrap protects payload for the client, encrypting it when confidential.
+	Wrap(payload []byte, confidential bool) ([]byte, error)
+	// Unwrap verifies a token from the client and returns its payload.
+	Unwrap(token []byte) ([]byte, error)
+	// SourceName is the client principal once the context is established.
+	SourceName() string
+}
+
+// NewGSSAPIAuthenticator returns the RFC 1961 method. newMechanism is called
+// once per session, clients asking for less protection than minLevel are
+// refused.
+func NewGSSAPIAuthenticator(newMechanism func() GSSAPIMechanism, minLevel byte) Authenticator {
+	return &gssapiAuthenticatorImpl{
+		newMechanism: newMechanism,
+		minLevel:     minLevel,
+	}
+}
+
+type gssapiAuthenticatorImpl struct {
+	newMechanism func() GSSAPIMechanism
+	minLevel     byte
+}
+
+func (self *gssapiAuthenticatorImpl) Method() byte {
+	return MethodGSSAPI
+}
+
+func (self *gssapiAuthenticatorImpl) Authenticate(sess *session.Session, conn net.Conn) (*session.Identity, error) {
+	mech := self.newMechanism()
+
+	if err := self.establish(conn, mech); err != nil {
+		abortGSSAPI(conn)
+		return nil, err
+	}
+
+	level, err := self.negotiateProtection(conn, mech)
+	if err != nil {
+		abortGSSAPI(conn)
+		return nil, err
+	}
+
+	// everything after the subnegotiation is encapsulated
+	sess.Conn = newGSSAPIConn(conn, mech, level != proto.GSSAPIIntegrity)
+
+	return &session.Identity{
+		Name:   mech.SourceName(),
+		Method: MethodGSSAPI,
+		Attributes: map[string]string{
+			"gssapi.protection": strconv.Itoa(int(level)),
+		},
+	}, nil
+}
+
+func (self *gssapiAuthenticatorImpl) establish(conn net.Conn, mech GSSAPIMechanism) error {
+	for {
+		msg, err := proto.ReadGSSAPIMessage(conn, proto.GSSAPIAuthentication)
+		if err != nil {
+			return err
+		}
+
+		output, done, err := mech.AcceptSecContext(msg.Token)
+		if err != nil {
+			return err
+		}
+
+		if len(output) > 0 {
+			reply := &proto.GSSAPIMessage{Ver: proto.GSSAPI_VERSION, MTyp: proto.GSSAPIAuthentication, Token: output}
+			if err := proto.WriteGSSAPIMessage(conn, reply); err != nil {
+				return err
+			}
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// negotiateProtection answers the client's protection level, both directions
+// carry a single wrapped octet.
+func (self *gssapiAuthenticatorImpl) negotiateProtection(conn net.Conn, mech GSSAPIMechanism) (byte, error) {
+	msg, err := proto.ReadGSSAPIMessage(conn, proto.GSSAPIProtection)
+	if err != nil {
+		return 0, err
+	}
+
+	payload, err := mech.Unwrap(msg.Token)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(payload) != 1 {
+		return 0, ERR_GSSAPI_PROTECTION
+	}
+
+	level := payload[0]
+	if level < proto.GSSAPIIntegrity || level > proto.GSSAPISelective || level < self.minLevel {
+		return 0, ERR_GSSAPI_PROTECTION
+	}
+
+	token, err := mech.Wrap([]byte{level}, false)
+	if err != nil {
+		return 0, err
+	}
+
+	reply := &proto.GSSAPIMessage{Ver: proto.GSSAPI_VERSION, MTyp: proto.GSSAPIProtection, Token: token}
+	if err := proto.WriteGSSAPIMessage(conn, reply); err != nil {
+		return 0, err
+	}
+
+	return level, nil
+}
+
+func abortGSSAPI(conn net.Conn) {
+	proto.WriteGSSAPIMessage(conn, &proto.GSSAPIMessage{Ver: proto.GSSAPI_VERSION, MTyp: proto.GSSAPIAbort})
+}
+
+// gssapiConn carries the rest of the session in encapsulation messages.
+type gssapiConn struct {
+	net.Conn
+	mech         GSSAPIMechanism
+	confidential bool
+
+	readLock sync.Mutex
+	pending  []byte
+	// the message being read, kept across reads that fail half way such as
+	// on a deadline so the next read goes on with it
+	partial []byte
+	msg     proto.GSSAPIMessage
+
+	writeLock sync.Mutex
+}
+
+func newGSSAPIConn(conn net.Conn, mech GSSAPIMechanism, confidential bool) *gssapiConn {
+	return &gssapiConn{
+		Conn:         conn,
+		mech:         mech,
+		confidential: confidential,
+	}
+}
+
+func (self *gssapiConn) Read(b []byte) (int, error) {
+	self.readLock.Lock()
+	defer self.readLock.Unlock()
+
+	for len(self.pending) == 0 {
+		token, err := self.readToken()
+		if err != nil {
+			return 0, err
+		}
+
+		self.pending, err = self.mech.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+// readToken reads the next encapsulation message into partial, the token is
+// valid until the next call.
+func (self *gssapiConn) readToken() ([]byte, error) {
+	for {
+		_, err := self.msg.Decode(self.partial)
+		if err == nil {
+			if self.msg.MTyp != proto.GSSAPIEncapsulation {
+				return nil, proto.ERR_GSSAPI_MSG_TYPE
+			}
+
+			self.partial = self.partial[:0]
+			return self.msg.Token, nil
+		}
+		if err != proto.ERR_SHORT_BUFFER {
+			return nil, err
+		}
+
+		// the header first, then the token it announces
+		have := len(self.partial)
+		need := 4
+		if have >= 4 {
+			need += int(binary.BigEndian.Uint16(self.partial[2:]))
+		}
+		if cap(self.partial) < need {
+			self.partial = append(make([]byte, 0, need), self.partial...)
+		}
+
+		n, err := self.Conn.Read(self.partial[have:need])
+		self.partial = self.partial[:have+n]
+		if err == io.EOF && len(self.partial) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (self *gssapiConn) Write(b []byte) (int, error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxGSSAPIPayload {
+			chunk = chunk[:maxGSSAPIPayload]
+		}
+
+		token, err := self.mech.Wrap(chunk, self.confidential)
+		if err != nil {
+			return written, err
+		}
+
+		msg := &proto.GSSAPIMessage{Ver: proto.GSSAPI_VERSION, MTyp: proto.GSSAPIEncapsulation, Token: token}
+		if err := proto.WriteGSSAPIMessage(self.Conn, msg); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
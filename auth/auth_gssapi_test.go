@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
+)
+
+var ERR_XOR_TOKEN = errors.New("xor token damaged")
+
+// xorMechanism stands in for a real GSSAPI provider: the context takes a
+// hello and a response token, Wrap XORs the payload with key and tags it with
+// the confidentiality asked for.
+type xorMechanism struct {
+	key  byte
+	step int
+	name string
+}
+
+func (self *xorMechanism) AcceptSecContext(token []byte) ([]byte, bool, error) {
+	self.step++
+	switch {
+	case self.step == 1 && string(token) == "hello":
+		return []byte("challenge"), false, nil
+	case self.step == 2 && string(token) == "response":
+		self.name = "alice@TEST"
+		return nil, true, nil
+	}
+
+	return nil, false, ERR_XOR_TOKEN
+}
+
+func (self *xorMechanism) Wrap(payload []byte, confidential bool) ([]byte, error) {
+	token := make([]byte, len(payload)+1)
+	for i, c := range payload {
+		token[i] = c ^ self.key
+	}
+	token[len(payload)] = 'I'
+	if confidential {
+		token[len(payload)] = 'C'
+	}
+
+	return token, nil
+}
+
+func (self *xorMechanism) Unwrap(token []byte) ([]byte, error) {
+	if len(token) == 0 || (token[len(token)-1] != 'I' && token[len(token)-1] != 'C') {
+		return nil, ERR_XOR_TOKEN
+	}
+
+	payload := make([]byte, len(token)-1)
+	for i := range payload {
+		payload[i] = token[i] ^ self.key
+	}
+
+	return payload, nil
+}
+
+func (self *xorMechanism) SourceName() string {
+	return self.name
+}
+
+// gssapiClient drives the client side of the subnegotiation with its own
+// mechanism instance, sharing the key.
+type gssapiClient struct {
+	conn net.Conn
+	mech *xorMechanism
+}
+
+func (self *gssapiClient) send(mtyp byte, token []byte) error {
+	return proto.WriteGSSAPIMessage(self.conn, &proto.GSSAPIMessage{Ver: proto.GSSAPI_VERSION, MTyp: mtyp, Token: token})
+}
+
+func (self *gssapiClient) establish(t *testing.T) {
+	if err := self.send(proto.GSSAPIAuthentication, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := proto.ReadGSSAPIMessage(self.conn, proto.GSSAPIAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Token) != "challenge" {
+		t.Fatalf("context token %q, want challenge", msg.Token)
+	}
+
+	if err := self.send(proto.GSSAPIAuthentication, []byte("response")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (self *gssapiClient) requestLevel(t *testing.T, level byte) {
+	token, _ := self.mech.Wrap([]byte{level}, false)
+	if err := self.send(proto.GSSAPIProtection, token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newGSSAPITest(t *testing.T, minLevel byte) (*session.Session, *gssapiClient, chan error, chan *session.Identity) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	sess := session.NewSession(context.Background(), server)
+	t.Cleanup(sess.Close)
+
+	authenticator := NewGSSAPIAuthenticator(func() GSSAPIMechanism {
+		return &xorMechanism{key: 0x5A}
+	}, minLevel)
+
+	errs := make(chan error, 1)
+	identities := make(chan *session.Identity, 1)
+	go func() {
+		identity, err := authenticator.Authenticate(sess, server)
+		identities <- identity
+		errs <- err
+	}()
+
+	return sess, &gssapiClient{conn: client, mech: &xorMechanism{key: 0x5A}}, errs, identities
+}
+
+func TestGSSAPIEstablish(t *testing.T) {
+	sess, client, errs, identities := newGSSAPITest(t, proto.GSSAPIIntegrity)
+
+	client.establish(t)
+	client.requestLevel(t, proto.GSSAPIConfidentiality)
+
+	msg, err := proto.ReadGSSAPIMessage(client.conn, proto.GSSAPIProtection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	level, err := client.mech.Unwrap(msg.Token)
+	if err != nil || !bytes.Equal(level, []byte{proto.GSSAPIConfidentiality}) {
+		t.Fatalf("protection reply %v, %v", level, err)
+	}
+
+	identity := <-identities
+	if err := <-errs; err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.Name != "alice@TEST" || identity.Method != MethodGSSAPI || identity.Attributes["gssapi.protection"] != "2" {
+		t.Fatalf("identity %+v", identity)
+	}
+
+	conn, ok := sess.Conn.(*gssapiConn)
+	if !ok || !conn.confidential {
+		t.Fatalf("session conn %T is not a confidential gssapi conn", sess.Conn)
+	}
+}
+
+func TestGSSAPIBadContextToken(t *testing.T) {
+	_, client, errs, _ := newGSSAPITest(t, proto.GSSAPIIntegrity)
+
+	if err := client.send(proto.GSSAPIAuthentication, []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the abort is VER and MTYP alone
+	abort := make([]byte, 2)
+	if _, err := io.ReadFull(client.conn, abort); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(abort, []byte{proto.GSSAPI_VERSION, proto.GSSAPIAbort}) {
+		t.Fatalf("abort % x", abort)
+	}
+
+	if err := <-errs; !errors.Is(err, ERR_XOR_TOKEN) {
+		t.Fatalf("Authenticate = %v, want ERR_XOR_TOKEN", err)
+	}
+}
+
+func TestGSSAPIProtectionBelowMinimum(t *testing.T) {
+	_, client, errs, _ := newGSSAPITest(t, proto.GSSAPIConfidentiality)
+
+	client.establish(t)
+	client.requestLevel(t, proto.GSSAPIIntegrity)
+
+	if _, err := proto.ReadGSSAPIMessage(client.conn, proto.GSSAPIProtection); !errors.Is(err, proto.ERR_GSSAPI_ABORT) {
+		t.Fatalf("protection reply = %v, want ERR_GSSAPI_ABORT", err)
+	}
+
+	if err := <-errs; !errors.Is(err, ERR_GSSAPI_PROTECTION) {
+		t.Fatalf("Authenticate = %v, want ERR_GSSAPI_PROTECTION", err)
+	}
+}
+
+func TestGSSAPIConnChunks(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	mech := &xorMechanism{key: 0x33}
+	conn := newGSSAPIConn(server, mech, true)
+	peer := &xorMechanism{key: 0x33}
+
+	// a write over the chunk size goes out in several messages
+	data := make([]byte, 2*maxGSSAPIPayload+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+
+	var got []byte
+	var sizes []int
+	for len(got) < len(data) {
+		msg, err := proto.ReadGSSAPIMessage(client, proto.GSSAPIEncapsulation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := peer.Unwrap(msg.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Token[len(msg.Token)-1] != 'C' {
+			t.Fatal("payload not wrapped confidentially")
+		}
+		sizes = append(sizes, len(payload))
+		got = append(got, payload...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("written data differs")
+	}
+	if len(sizes) != 3 || sizes[0] != maxGSSAPIPayload || sizes[1] != maxGSSAPIPayload || sizes[2] != 100 {
+		t.Fatalf("chunks %v, want %v, %v, 100", sizes, maxGSSAPIPayload, maxGSSAPIPayload)
+	}
+
+	// reads hand out one message across several small buffers
+	go func() {
+		for _, part := range [][]byte{data[:maxGSSAPIPayload], data[maxGSSAPIPayload:]} {
+			token, _ := peer.Wrap(part, true)
+			proto.WriteGSSAPIMessage(client, &proto.GSSAPIMessage{Ver: proto.GSSAPI_VERSION, MTyp: proto.GSSAPIEncapsulation, Token: token})
+		}
+	}()
+
+	read := make([]byte, 0, len(data))
+	buf := make([]byte, 1000)
+	for len(read) < len(data) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, buf[:n]...)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("read data differs")
+	}
+}
+
+func TestGSSAPIConnReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := newGSSAPIConn(server, &xorMechanism{key: 0x33}, true)
+	peer := &xorMechanism{key: 0x33}
+
+	token, _ := peer.Wrap([]byte("split message"), true)
+	msg, _ := (&proto.GSSAPIMessage{Ver: proto.GSSAPI_VERSION, MTyp: proto.GSSAPIEncapsulation, Token: token}).AppendBinary(nil)
+
+	// the message arrives in two pieces with a deadline passing in between
+	go client.Write(msg[:6])
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read = %v, want a deadline error", err)
+	}
+
+	go client.Write(msg[6:])
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "split message" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/lkyzhu/socks5/session"
+)
+
+var (
+	ERR_PROXY_AUTH_REQUIRED = errors.New("proxy authentication required")
+)
+
+// AuthenticateHTTP checks the Proxy-Authorization of an HTTP proxy request
+// against the registered username/password authenticator. Requests without
+// credentials pass only when the no-authentication method is registered.
+func (self *AuthenticatorMgr) AuthenticateHTTP(sess *session.Session, req *http.Request) (*session.Identity, error) {
+	user, passwd, hasAuth := proxyBasicAuth(req)
+
+	if hasAuth {
+		if !self.allowed(sess, MethodUserPassword) {
+			return nil, ERR_PROXY_AUTH_REQUIRED
+		}
+
+		val, exist := self.authenticators.Load(MethodUserPassword)
+		if !exist {
+			return nil, ERR_PROXY_AUTH_REQUIRED
+		}
+
+		authenticator, ok := val.(UserPassAuthenticator)
+		if !ok {
+			return nil, ERR_PROXY_AUTH_REQUIRED
+		}
+
+		ok, err := authenticator.Validate(user, passwd)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return nil, ERR_INVALID_USER_PASSWORD
+		}
+
+		return &session.Identity{Name: user, Method: MethodUserPassword}, nil
+	}
+
+	if sess.Identity != nil {
+		return sess.Identity, nil
+	}
+
+	if self.Supports(MethodNoAuth) {
+		return &session.Identity{Method: MethodNoAuth}, nil
+	}
+
+	return nil, ERR_PROXY_AUTH_REQUIRED
+}
+
+// proxyBasicAuth parses Proxy-Authorization the way http.Request.BasicAuth
+// parses Authorization.
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+
+	r := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	return r.BasicAuth()
+}
@@ -2,6 +2,8 @@ package auth
 
 import (
 	"net"
+
+	"github.com/lkyzhu/socks5/session"
 )
 
 const (
@@ -19,6 +21,6 @@ func (self *noAuthAuthenticatorImpl) Method() byte {
 	return MethodNoAuth
 }
 
-func (self *noAuthAuthenticatorImpl) Authenticate(conn net.Conn) error {
-	return nil
+func (self *noAuthAuthenticatorImpl) Authenticate(sess *session.Session, conn net.Conn) (*session.Identity, error) {
+	return &session.Identity{Method: MethodNoAuth}, nil
 }
@@ -4,7 +4,8 @@ import (
 	"errors"
 	"net"
 
-	"github.com/lkyzhu/socks5/internal/proto"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
 )
 
 const (
@@ -44,26 +45,29 @@ func (self *userPassAuthenticatorImpl) Method() byte {
 	return MethodUserPassword
 }
 
-func (self *userPassAuthenticatorImpl) Authenticate(conn net.Conn) error {
+func (self *userPassAuthenticatorImpl) Authenticate(sess *session.Session, conn net.Conn) (*session.Identity, error) {
 	req, err := proto.ReadUserPasswordRequest(conn)
 	if err != nil {
-		proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.VERSION, Status: proto.AuthFailure})
-		return err
+		proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.USERPASS_VERSION, Status: proto.AuthFailure})
+		return nil, err
 	}
 
 	ok, err := self.store.Validate(string(req.Uname), string(req.Passwd))
 	if err != nil {
-		proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.VERSION, Status: proto.AuthFailure})
-		return err
+		proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.USERPASS_VERSION, Status: proto.AuthFailure})
+		return nil, err
 	}
 
 	if !ok {
-		proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.VERSION, Status: proto.AuthFailure})
-		return ERR_INVALID_USER_PASSWORD
+		proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.USERPASS_VERSION, Status: proto.AuthFailure})
+		return nil, ERR_INVALID_USER_PASSWORD
 	}
 
-	proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.VERSION, Status: proto.AuthSuccess})
-	return nil
+	if err := proto.WriteAuthReply(conn, &proto.AuthReply{Ver: proto.USERPASS_VERSION, Status: proto.AuthSuccess}); err != nil {
+		return nil, err
+	}
+
+	return &session.Identity{Name: string(req.Uname), Method: MethodUserPassword}, nil
 }
 
 func (self *userPassAuthenticatorImpl) Create(user, passwd string) error {
@@ -1,20 +1,29 @@
 package auth
 
 import (
+	"errors"
 	"net"
 	"sync"
 
-	"github.com/lkyzhu/socks5/internal/context"
-	"github.com/lkyzhu/socks5/internal/proto"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
 )
 
 const (
-	MethodNoAcceptable byte = 0xFF
+	// MethodTLSClientCert marks identities taken from a TLS client
+	// certificate, it lies in the private range and is never negotiated.
+	MethodTLSClientCert byte = 0x80
+	MethodNoAcceptable  byte = 0xFF
+)
+
+var (
+	ERR_NO_ACCEPTABLE_METHOD = errors.New("no acceptable methods")
 )
 
 type Authenticator interface {
-	//Authenticate(conn net.Conn, method *proto.MethodRequest) error
-	Authenticate(conn net.Conn) error
+	// Authenticate runs the method's subnegotiation and returns who was
+	// authenticated.
+	Authenticate(sess *session.Session, conn net.Conn) (*session.Identity, error)
 	Method() byte
 }
 
@@ -23,29 +32,70 @@ type Config struct {
 
 type AuthenticatorMgr struct {
 	authenticators sync.Map
+	tlsOnly        sync.Map
 }
 
 func (self *AuthenticatorMgr) Regist(auth Authenticator) {
 	self.authenticators.Store(auth.Method(), auth)
 }
 
-func (self *AuthenticatorMgr) Authenticate(ctx *context.Context, conn net.Conn, req *proto.MethodRequest) error {
-	ctx.Logger.Debugf("request with method:%v", req.Methods)
+// RequireTLS refuses method on sessions that did not arrive over TLS, e.g.
+// MethodUserPassword whose credentials travel in cleartext.
+func (self *AuthenticatorMgr) RequireTLS(method byte) {
+	self.tlsOnly.Store(method, struct{}{})
+}
+
+func (self *AuthenticatorMgr) allowed(sess *session.Session, method byte) bool {
+	if sess.TLS != nil {
+		return true
+	}
+
+	_, tlsOnly := self.tlsOnly.Load(method)
+	return !tlsOnly
+}
+
+// Supports reports whether an authenticator for method is registered.
+func (self *AuthenticatorMgr) Supports(method byte) bool {
+	_, exist := self.authenticators.Load(method)
+	return exist
+}
+
+func (self *AuthenticatorMgr) Authenticate(sess *session.Session, conn net.Conn, req *proto.MethodRequest) error {
+	sess.Logger.Debugf("request with method:%v", req.Methods)
 	for _, m := range req.Methods {
+		if !self.allowed(sess, m) {
+			sess.Logger.Debugf("method:%v refused without tls", m)
+			continue
+		}
+
 		if val, exist := self.authenticators.Load(m); exist {
 			if authenticator, ok := val.(Authenticator); !ok {
 				continue
 			} else {
-				proto.WriteMethodReply(conn, &proto.MethodReply{Ver: proto.VERSION, Method: authenticator.Method()})
-				return authenticator.Authenticate(conn)
+				writeMethodReply(conn, authenticator.Method())
+				identity, err := authenticator.Authenticate(sess, conn)
+				if err != nil {
+					return err
+				}
+
+				// an anonymous method keeps the client certificate identity
+				if sess.Identity == nil || identity == nil || identity.Name != "" {
+					sess.SetIdentity(identity)
+				}
+				return nil
 			}
 		}
 	}
 
-	return self.invalidMethod(conn)
+	self.invalidMethod(conn)
+	return ERR_NO_ACCEPTABLE_METHOD
 }
 
 func (self *AuthenticatorMgr) invalidMethod(conn net.Conn) error {
-	rep := &proto.MethodReply{Ver: proto.VERSION, Method: MethodNoAcceptable}
-	return proto.WriteMethodReply(conn, rep)
+	return writeMethodReply(conn, MethodNoAcceptable)
+}
+
+func writeMethodReply(conn net.Conn, method byte) error {
+	rep := proto.MethodReply{Ver: proto.VERSION, Method: method}
+	return rep.Write(conn)
 }
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/lkyzhu/socks5/internal/netutil"
+	"github.com/lkyzhu/socks5/proto"
+)
+
+const (
+	MethodNoAuth       byte = 0x00
+	MethodUserPassword byte = 0x02
+	MethodNoAcceptable byte = 0xFF
+)
+
+var (
+	ERR_NO_ACCEPTABLE_METHOD  = errors.New("no acceptable authentication method")
+	ERR_AUTH_FAILED           = errors.New("username/password authentication failed")
+	ERR_UNSUPPORTED_NETWORK   = errors.New("unsupported network")
+	ERR_INVALID_USER_PASSWORD = errors.New("user or password is too long")
+	ERR_DOMAIN_TOO_LONG       = errors.New("domain is too long")
+)
+
+// Auth holds the RFC 1929 credentials offered to the proxy.
+type Auth struct {
+	User     string
+	Password string
+}
+
+// ContextDialer dials the proxy itself, it allows chaining proxies.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type Option func(*Dialer)
+
+// WithForward makes the Dialer reach the proxy through forward instead of
+// dialing it directly.
+func WithForward(forward ContextDialer) Option {
+	return func(self *Dialer) {
+		self.forward = forward
+	}
+}
+
+// WithTLS makes the Dialer speak SOCKS over TLS to the proxy. When config
+// has no ServerName the proxy's host name is used.
+func WithTLS(config *tls.Config) Option {
+	return func(self *Dialer) {
+		self.tls = config
+	}
+}
+
+// ReplyError is returned when the proxy answers a command with a reply code
+// other than success.
+type ReplyError struct {
+	Code byte
+}
+
+func (self *ReplyError) Error() string {
+	code := proto.ReplyCode(self.Code)
+	return code.String()
+}
+
+func (self *ReplyError) ReplyCode() byte {
+	return self.Code
+}
+
+// Dialer connects to addresses through a SOCKS5 proxy. It implements the
+// Dialer and ContextDialer interfaces of golang.org/x/net/proxy, and its
+// DialContext method can be used as http.Transport.DialContext.
+type Dialer struct {
+	network string
+	addr    string
+	auth    *Auth
+	forward ContextDialer
+	tls     *tls.Config
+}
+
+// NewDialer returns a Dialer for the proxy listening on addr. auth may be nil,
+// in which case only the no-authentication method is offered.
+func NewDialer(network, addr string, auth *Auth, opts ...Option) *Dialer {
+	d := &Dialer{
+		network: network,
+		addr:    addr,
+		auth:    auth,
+		forward: &net.Dialer{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
+}
+
+func (self *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return self.DialContext(context.Background(), network, addr)
+}
+
+func (self *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ERR_UNSUPPORTED_NETWORK
+	}
+
+	dest, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := self.forward.DialContext(ctx, self.network, self.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.tls != nil {
+		conn, err = self.handshakeTLS(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// abort the handshake when ctx is done
+	stop := netutil.WatchContext(ctx, conn)
+	err = self.handshake(conn, dest)
+	if stopErr := stop(); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (self *Dialer) handshakeTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	config := self.tls
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(self.addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func (self *Dialer) handshake(conn net.Conn, dest proto.Addr) error {
+	methods := []byte{MethodNoAuth}
+	if self.auth != nil {
+		methods = append(methods, MethodUserPassword)
+	}
+
+	req := &proto.MethodRequest{Ver: proto.VERSION, NMethods: byte(len(methods)), Methods: methods}
+	if err := proto.WriteMethodRequest(conn, req); err != nil {
+		return err
+	}
+
+	rep, err := proto.ReadMethodReply(conn)
+	if err != nil {
+		return err
+	}
+
+	switch rep.Method {
+	case MethodNoAuth:
+	case MethodUserPassword:
+		if self.auth == nil {
+			return ERR_NO_ACCEPTABLE_METHOD
+		}
+		if err := self.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return ERR_NO_ACCEPTABLE_METHOD
+	}
+
+	cmd := &proto.CommandRequest{Ver: proto.VERSION, Cmd: proto.Connect, Dest: dest}
+	if err := proto.WriteCommandRequest(conn, cmd); err != nil {
+		return err
+	}
+
+	reply, err := proto.ReadCommandReply(conn)
+	if err != nil {
+		return err
+	}
+
+	if reply.Ver != proto.VERSION {
+		return proto.ERR_INVALID_VERSION
+	}
+
+	if proto.ReplyCode(reply.Rep) != proto.Success {
+		return &ReplyError{Code: reply.Rep}
+	}
+
+	return nil
+}
+
+func (self *Dialer) authenticate(conn net.Conn) error {
+	if len(self.auth.User) == 0 || len(self.auth.User) > 255 || len(self.auth.Password) == 0 || len(self.auth.Password) > 255 {
+		return ERR_INVALID_USER_PASSWORD
+	}
+
+	req := &proto.UserPasswordRequest{
+		Ver:    proto.USERPASS_VERSION,
+		Ulen:   byte(len(self.auth.User)),
+		Uname:  []byte(self.auth.User),
+		Plen:   byte(len(self.auth.Password)),
+		Passwd: []byte(self.auth.Password),
+	}
+	if err := proto.WriteUserPasswordRequest(conn, req); err != nil {
+		return err
+	}
+
+	rep, err := proto.ReadAuthReply(conn)
+	if err != nil {
+		return err
+	}
+
+	if rep.Status != proto.AuthSuccess {
+		return ERR_AUTH_FAILED
+	}
+
+	return nil
+}
+
+func parseAddr(addr string) (proto.Addr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return proto.Addr{}, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return proto.Addr{}, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return proto.NewAddr(ip, int(port)), nil
+	}
+
+	if len(host) > 255 {
+		return proto.Addr{}, ERR_DOMAIN_TOO_LONG
+	}
+
+	return proto.Addr{Type: proto.ATYP_DOMAIN, Domain: host, Port: uint16(port)}, nil
+}
@@ -1,12 +1,185 @@
 package command
 
 import (
+	"io"
 	"net"
+	"time"
 
-	"github.com/lkyzhu/socks5/internal/context"
-	"github.com/lkyzhu/socks5/internal/proto"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
 )
 
-func (self *handler) Associate(ctx *context.Context, conn net.Conn, request *proto.CommandRequest) error {
+const (
+	udpBufferSize = 64 * 1024
+)
+
+func (self *handler) Associate(sess *session.Session, conn net.Conn, request *proto.CommandRequest) error {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("listen udp relay fail")
+		self.SendReply(sess, conn, proto.ServerFailure, proto.Addr{})
+		return err
+	}
+	defer relay.Close()
+
+	// the relay is advertised on the interface the client reached us on
+	bnd := &net.UDPAddr{Port: relay.LocalAddr().(*net.UDPAddr).Port}
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bnd.IP = tcpAddr.IP
+	}
+	if err := self.SendReply(sess, conn, proto.Success, bndAddr(sess, bnd.IP, bnd.Port)); err != nil {
+		return err
+	}
+
+	sess.Logger.Debugf("udp associate relay[%v] for client[%v] begin", bnd.String(), conn.RemoteAddr().String())
+
+	// the association terminates when the tcp connection it arrived on terminates
+	go func() {
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	client := &udpClient{
+		expect: request.Dest,
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client.ip = tcpAddr.IP
+	}
+
+	self.relayUDP(sess, relay, client)
+
+	sess.Logger.Debugf("udp associate relay[%v] for client[%v] end", bnd.String(), conn.RemoteAddr().String())
 	return nil
 }
+
+// udpClient tracks the address the client sends its datagrams from.
+type udpClient struct {
+	ip     net.IP
+	expect proto.Addr
+	addr   *net.UDPAddr
+}
+
+// match reports whether a datagram from src belongs to the client. The
+// DST.ADDR/DST.PORT of the ASSOCIATE request may be zero when the client does
+// not know its address yet, so only the non-zero parts are checked.
+func (self *udpClient) match(src *net.UDPAddr) bool {
+	if self.addr != nil {
+		return self.addr.IP.Equal(src.IP) && self.addr.Port == src.Port
+	}
+
+	if self.expect.IP != nil && !self.expect.IP.IsUnspecified() {
+		if !self.expect.IP.Equal(src.IP) {
+			return false
+		}
+	} else if self.ip != nil && !self.ip.Equal(src.IP) {
+		return false
+	}
+
+	if self.expect.Port != 0 && int(self.expect.Port) != src.Port {
+		return false
+	}
+
+	self.addr = src
+	return true
+}
+
+func (self *handler) relayUDP(sess *session.Session, relay *net.UDPConn, client *udpClient) {
+	buf := make([]byte, udpBufferSize)
+	out := make([]byte, 0, udpBufferSize+3+1+1+255+2)
+	var request, reply proto.UDPRequest
+	upload, download := self.limiters(sess)
+	for {
+		// an association without datagrams either way for the idle timeout ends
+		if self.idleTimeout > 0 {
+			relay.SetReadDeadline(time.Now().Add(self.idleTimeout))
+		}
+
+		n, src, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		fromClient := client.match(src)
+		if !fromClient && !self.allowedSource(sess, src) {
+			continue
+		}
+
+		// datagrams arriving while the relay waits for tokens queue in the
+		// socket and are dropped when it fills
+		limiters := download
+		if fromClient {
+			limiters = upload
+		}
+		for _, limiter := range limiters {
+			if err := limiter.WaitN(sess, n); err != nil {
+				return
+			}
+		}
+
+		if fromClient {
+			self.forwardUDP(sess, relay, &request, buf[:n])
+			continue
+		}
+
+		if client.addr == nil {
+			// nothing to deliver to until the client has sent its first datagram
+			continue
+		}
+
+		reply.Dest = proto.NewAddr(src.IP, src.Port)
+		reply.Data = buf[:n]
+		packet, err := reply.AppendBinary(out[:0])
+		if err != nil {
+			sess.Logger.WithError(err).Errorf("build udp reply from [%v] fail", src.String())
+			continue
+		}
+
+		if _, err := relay.WriteToUDP(packet, client.addr); err != nil {
+			sess.Logger.WithError(err).Errorf("send udp reply to client[%v] fail", client.addr.String())
+		}
+	}
+}
+
+func (self *handler) forwardUDP(sess *session.Session, relay *net.UDPConn, request *proto.UDPRequest, packet []byte) {
+	_, err := request.Decode(packet)
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("parse udp request fail")
+		return
+	}
+
+	// fragmentation is optional, datagrams with FRAG other than 0 are dropped
+	if request.Frag != 0 {
+		sess.Logger.Debugf("drop udp fragment:%v", request.Frag)
+		return
+	}
+
+	ip := request.Dest.IP
+	if request.Dest.Domain != "" {
+		ips, err := self.lookup(sess, request.Dest.Domain)
+		if err != nil {
+			sess.Logger.WithError(err).Errorf("resolve domain[%v] fail", request.Dest.Domain)
+			return
+		}
+		ip = ips[0]
+	}
+
+	// every datagram is a request of its own to the rules
+	check := proto.CommandRequest{Ver: proto.VERSION, Cmd: proto.Associate, Dest: request.Dest}
+	check.Dest.IP = ip
+	if err := self.checkRules(sess, &check); err != nil {
+		return
+	}
+
+	dest := &net.UDPAddr{IP: ip, Port: int(request.Dest.Port)}
+	if _, err := relay.WriteToUDP(request.Data, dest); err != nil {
+		sess.Logger.WithError(err).Errorf("send udp to [%v] fail", dest.String())
+	}
+}
+
+// allowedSource checks a datagram on its way to the client against the rules
+// as if the client had sent to its source, a denied host can not reach the
+// client either.
+func (self *handler) allowedSource(sess *session.Session, src *net.UDPAddr) bool {
+	check := proto.CommandRequest{Ver: proto.VERSION, Cmd: proto.Associate, Dest: proto.NewAddr(src.IP, src.Port)}
+	return self.checkRules(sess, &check) == nil
+}
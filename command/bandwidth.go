@@ -0,0 +1,40 @@
+package command
+
+import (
+	"github.com/lkyzhu/socks5/limit"
+	"github.com/lkyzhu/socks5/session"
+)
+
+// WithBandwidth limits the relay of all sessions together.
+func WithBandwidth(bandwidth *limit.Bandwidth) Option {
+	return func(self *handler) {
+		self.bandwidth = bandwidth
+	}
+}
+
+// WithUserBandwidth limits the relay of each authenticated identity, shared
+// by all of its sessions. Anonymous sessions are not limited by it.
+func WithUserBandwidth(users *limit.UserBandwidth) Option {
+	return func(self *handler) {
+		self.userBandwidth = users
+	}
+}
+
+// limiters collects the upload and download buckets the session's relay is
+// charged to: global, the listener's and the identity's.
+func (self *handler) limiters(sess *session.Session) (upload, download []*limit.Limiter) {
+	bandwidths := []*limit.Bandwidth{self.bandwidth, sess.Bandwidth}
+	if self.userBandwidth != nil && sess.Identity != nil && sess.Identity.Name != "" {
+		bandwidths = append(bandwidths, self.userBandwidth.Get(sess.Identity.Name))
+	}
+
+	for _, bandwidth := range bandwidths {
+		if bandwidth == nil {
+			continue
+		}
+		upload = append(upload, bandwidth.Upload)
+		download = append(download, bandwidth.Download)
+	}
+
+	return upload, download
+}
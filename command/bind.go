@@ -1,66 +1,156 @@
 package command
 
 import (
+	"errors"
+	"math/rand"
 	"net"
-	"strconv"
+	"time"
 
-	"github.com/lkyzhu/socks5/internal/context"
-	"github.com/lkyzhu/socks5/internal/proto"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/rule"
+	"github.com/lkyzhu/socks5/session"
 )
 
-func (self *handler) Bind(ctx *context.Context, conn net.Conn, request *proto.CommandRequest) error {
-	addr := net.JoinHostPort(request.Dest.IP.String(), strconv.Itoa(int(request.Dest.Port)))
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		self.SendReply(conn, proto.ServerFailure, proto.Addr{})
-		return err
-	}
+const (
+	defaultBindTimeout = 2 * time.Minute
+)
 
-	defer listener.Close()
+var (
+	ERR_BIND_NO_PORT = errors.New("no free port in bind range")
+)
 
-	local := listener.Addr()
+// WithBindAddr makes BIND listen on ip, by default it listens on the address
+// the client reached the server on.
+func WithBindAddr(ip net.IP) Option {
+	return func(self *handler) {
+		self.bindIP = ip
+	}
+}
 
-	bnd := proto.Addr{
-		Type: proto.ATYP_IPV4,
+// WithBindPorts makes BIND pick its listening port from ports instead of
+// letting the system choose one.
+func WithBindPorts(ports rule.PortRange) Option {
+	return func(self *handler) {
+		self.bindPorts = ports
 	}
-	if tcpAddr, ok := local.(*net.TCPAddr); ok {
-		bnd.IP = tcpAddr.IP
-		bnd.Port = uint16(tcpAddr.Port)
+}
+
+// WithBindTimeout limits how long BIND waits for the incoming connection.
+func WithBindTimeout(timeout time.Duration) Option {
+	return func(self *handler) {
+		self.bindTimeout = timeout
 	}
+}
 
-	if bnd.IP.To16() != nil {
-		bnd.Type = proto.ATYP_IPV6
+// Bind serves RFC 1928 BIND: DST.ADDR names the host expected to connect
+// back, the server listens on its own address and reports it in the first
+// reply, the second reply carries the address of the peer that connected.
+// ips are the addresses DST.ADDR resolved to, the peer may come from any.
+func (self *handler) Bind(sess *session.Session, conn net.Conn, request *proto.CommandRequest, ips []net.IP) error {
+	listener, err := self.listenBind(conn)
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("listen for bind fail")
+		self.SendReply(sess, conn, proto.ReplyCodeFromError(err), proto.Addr{})
+		return err
 	}
+	defer listener.Close()
 
-	self.SendReply(conn, proto.Success, bnd)
+	local := listener.Addr().(*net.TCPAddr)
+	self.SendReply(sess, conn, proto.Success, bndAddr(sess, local.IP, local.Port))
 
-	dest, err := listener.Accept()
+	dest, err := self.acceptBind(sess, listener, ips)
 	if err != nil {
-		self.SendReply(conn, proto.ServerFailure, proto.Addr{})
+		sess.Logger.WithError(err).Errorf("accept bind addr[%v] fail", local.String())
+		self.SendReply(sess, conn, proto.ReplyCodeFromError(err), proto.Addr{})
 		return err
 	}
-
 	defer dest.Close()
 
-	rbnd := proto.Addr{
-		Type: proto.ATYP_IPV4,
+	remote, ok := dest.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		self.SendReply(sess, conn, proto.AddressTypeNotSupport, proto.Addr{})
+		return proto.ERR_INVALID_ADDR
 	}
-	rAddr := dest.RemoteAddr()
-	if tcpAddr, ok := rAddr.(*net.TCPAddr); ok {
-		rbnd.IP = tcpAddr.IP
-		rbnd.Port = uint16(tcpAddr.Port)
-	} else {
-		self.SendReply(conn, proto.AddressTypeNotSupport, proto.Addr{})
-		return err
+
+	self.SendReply(sess, conn, proto.Success, proto.NewAddr(remote.IP, remote.Port))
+
+	return self.proxy(sess, conn, dest).Err
+}
+
+func (self *handler) listenBind(conn net.Conn) (*net.TCPListener, error) {
+	ip := self.bindIP
+	if ip == nil {
+		if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			ip = tcpAddr.IP
+		}
+	}
+
+	if self.bindPorts.Max == 0 || self.bindPorts.Max < self.bindPorts.Min {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
 	}
 
-	if rbnd.IP.To16() != nil {
-		rbnd.Type = proto.ATYP_IPV6
+	// start at a random port so concurrent binds do not race for the same one
+	count := int(self.bindPorts.Max) - int(self.bindPorts.Min) + 1
+	start := rand.Intn(count)
+	for i := 0; i < count; i++ {
+		port := int(self.bindPorts.Min) + (start+i)%count
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return listener, nil
+		}
+	}
+
+	return nil, ERR_BIND_NO_PORT
+}
+
+// acceptBind waits for the connection from one of expect, connections from
+// other hosts are closed and the wait goes on. No address or an unspecified
+// one admits any host. Only the address is checked, the peer's source port is
+// rarely known.
+func (self *handler) acceptBind(sess *session.Session, listener *net.TCPListener, expect []net.IP) (net.Conn, error) {
+	timeout := self.bindTimeout
+	if timeout == 0 {
+		timeout = defaultBindTimeout
 	}
+	listener.SetDeadline(time.Now().Add(timeout))
 
-	self.SendReply(conn, proto.Success, rbnd)
+	// shutting down the server aborts the wait
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-sess.Done():
+			listener.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
 
-	self.proxy(ctx, conn, dest)
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+
+		remote := conn.RemoteAddr().(*net.TCPAddr)
+		if expectedPeer(expect, remote.IP) {
+			return conn, nil
+		}
+
+		sess.Logger.Warnf("bind ignore connection from [%v], expect %v", remote.String(), expect)
+		conn.Close()
+	}
+}
+
+func expectedPeer(expect []net.IP, ip net.IP) bool {
+	if len(expect) == 0 {
+		return true
+	}
+
+	for _, e := range expect {
+		if e == nil || e.IsUnspecified() || e.Equal(ip) {
+			return true
+		}
+	}
 
-	return nil
+	return false
 }
@@ -0,0 +1,60 @@
+//go:build linux
+
+package command
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lkyzhu/socks5/proto"
+)
+
+// dialFrom connects to addr from the loopback address ip, linux routes all
+// of 127.0.0.0/8 to lo.
+func dialFrom(t *testing.T, ip net.IP, addr proto.Addr) *net.TCPConn {
+	conn, err := net.DialTCP("tcp", &net.TCPAddr{IP: ip}, &net.TCPAddr{IP: addr.IP, Port: int(addr.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestBindAcceptsAnyResolvedAddress(t *testing.T) {
+	h := NewHandler(staticResolver(nil), WithBindAddr(net.IPv4(127, 0, 0, 1)), WithBindTimeout(2*time.Second)).(*handler)
+	sess, peer := newTestSession(t)
+	sess.Version = proto.VERSION
+
+	request := &proto.CommandRequest{
+		Ver:  proto.VERSION,
+		Cmd:  proto.Bind,
+		Dest: proto.Addr{Type: proto.ATYP_DOMAIN, Domain: "ftp.example.test", IP: net.IPv4(127, 0, 0, 3)},
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 3), net.IPv4(127, 0, 0, 2)}
+	go h.Bind(sess, sess.Conn, request, ips)
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	first, err := proto.ReadCommandReply(peer)
+	if err != nil || first.Rep != byte(proto.Success) {
+		t.Fatalf("first reply %+v, %v", first, err)
+	}
+
+	// a host the domain did not resolve to is turned away
+	stranger := dialFrom(t, net.IPv4(127, 0, 0, 5), first.Bnd)
+	stranger.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := stranger.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("stranger read %v bytes, want closed", n)
+	}
+
+	// the second address of the domain is as good as the first
+	dialFrom(t, net.IPv4(127, 0, 0, 2), first.Bnd)
+	second, err := proto.ReadCommandReply(peer)
+	if err != nil || second.Rep != byte(proto.Success) {
+		t.Fatalf("second reply %+v, %v", second, err)
+	}
+	if !second.Bnd.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("second reply from %v, want 127.0.0.2", second.Bnd.IP)
+	}
+}
@@ -3,76 +3,315 @@ package command
 import (
 	"errors"
 	"net"
+	"strconv"
+	"time"
 
 	sc "context"
 
-	"github.com/lkyzhu/socks5/internal/context"
-	"github.com/lkyzhu/socks5/internal/proto"
+	"github.com/lkyzhu/socks5/auth"
+	"github.com/lkyzhu/socks5/limit"
+	"github.com/lkyzhu/socks5/outbound"
+	"github.com/lkyzhu/socks5/proto"
 	"github.com/lkyzhu/socks5/resolve"
+	"github.com/lkyzhu/socks5/rule"
+	"github.com/lkyzhu/socks5/session"
+)
+
+var (
+	ERR_RULE_DENIED = errors.New("connection not allowed by ruleset")
 )
 
 type Handler interface {
 	resolve.Resolver
-	Process(ctx *context.Context, conn net.Conn) error
+	Process(sess *session.Session, conn net.Conn) error
+}
+
+type Option func(*handler)
+
+// WithRuleset makes the handler evaluate rules on every request, denied
+// requests are answered with RuleFailure.
+func WithRuleset(rules rule.Ruleset) Option {
+	return func(self *handler) {
+		self.rules = rules
+	}
+}
+
+// WithDialer makes CONNECT reach its destination through dialer, such as an
+// upstream proxy, instead of dialing it directly.
+func WithDialer(dialer outbound.Dialer) Option {
+	return func(self *handler) {
+		self.dialer = dialer
+	}
 }
 
 type handler struct {
 	resolver resolve.Resolver
+	rules    rule.Ruleset
+	dialer   outbound.Dialer
+
+	preferredFamily string
+	attemptDelay    time.Duration
+	dialTimeout     time.Duration
+	idleTimeout     time.Duration
+
+	bindIP      net.IP
+	bindPorts   rule.PortRange
+	bindTimeout time.Duration
+
+	bandwidth     *limit.Bandwidth
+	userBandwidth *limit.UserBandwidth
 }
 
-func NewHandler(resolver resolve.Resolver) Handler {
-	return &handler{resolver: resolver}
+func NewHandler(resolver resolve.Resolver, opts ...Option) Handler {
+	h := &handler{
+		resolver: resolver,
+		dialer:   outbound.NewDirectDialer(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
 }
 
-func (self *handler) Process(ctx *context.Context, conn net.Conn) error {
-	request, err := proto.ReadCommandRequest(conn)
+func (self *handler) Process(sess *session.Session, conn net.Conn) error {
+	request := &proto.CommandRequest{}
+	if self.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(self.idleTimeout))
+	}
+	err := self.readRequest(sess, conn, request)
+	if self.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
 	if err != nil {
-		ctx.Logger.WithError(err).Errorf("read command fail")
+		sess.Logger.WithError(err).Errorf("read command fail")
+
+		// a malformed request can still be answered, a broken conn can not
+		if errors.Is(err, proto.ERR_INVALID_ADDR) || errors.Is(err, proto.ERR_INVALID_VERSION) || errors.Is(err, proto.ERR_INVALID_RESERVED) {
+			self.SendReply(sess, conn, proto.ReplyCodeFromError(err), proto.Addr{})
+		}
 		return err
 	}
 
-	if request.Dest.Domain != "" {
-		ip, err := self.resolver.Resolve(sc.Background(), request.Dest.Domain)
-		if err != nil {
-			ctx.Logger.WithError(err).Errorf("resolve domain[%v] fail", request.Dest.Domain)
-			return err
+	ips, err := self.route(sess, request)
+	if err != nil {
+		code := proto.ReplyCodeFromError(err)
+		if errors.Is(err, ERR_RULE_DENIED) {
+			code = proto.RuleFailure
 		}
+		self.SendReply(sess, conn, code, proto.Addr{})
+		return err
+	}
+
+	return self.HandleCommand(sess, conn, request, ips)
+}
+
+// route resolves the destination and checks the rules. A domain whose rule
+// asks for remote resolution is left unresolved and no addresses are
+// returned, the outbound dialer gets the name.
+func (self *handler) route(sess *session.Session, request *proto.CommandRequest) ([]net.IP, error) {
+	if request.Dest.Domain != "" && self.rules != nil {
+		// only the domain is known to the rules at this point
+		if matched := self.rules.Evaluate(sess, request); matched.RemoteResolve {
+			sess.Logger.Debugf("leave domain[%v] to the outbound dialer", request.Dest.Domain)
+			return nil, self.applyRule(sess, request, matched)
+		}
+	}
+
+	ips, err := self.resolveDest(sess, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.allowedIPs(sess, request, ips)
+}
+
+// allowedIPs checks every address of the destination against the rules, the
+// dial may end up at any of them. Denied addresses are dropped and the first
+// one left becomes the request's IP, with none left the request is denied.
+func (self *handler) allowedIPs(sess *session.Session, request *proto.CommandRequest, ips []net.IP) ([]net.IP, error) {
+	if self.rules == nil {
+		return ips, nil
+	}
+
+	allowed := make([]net.IP, 0, len(ips))
+	var err error
+	for _, ip := range ips {
 		request.Dest.IP = ip
+		if err = self.checkRules(sess, request); err == nil {
+			allowed = append(allowed, ip)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, err
+	}
+
+	request.Dest.IP = allowed[0]
+	return allowed, nil
+}
+
+// resolveDest returns every address of the destination, the first one is
+// also set as the request's IP for the rules to match.
+func (self *handler) resolveDest(sess *session.Session, request *proto.CommandRequest) ([]net.IP, error) {
+	if request.Dest.Domain == "" {
+		return []net.IP{request.Dest.IP}, nil
+	}
+
+	ips, err := self.lookup(sess, request.Dest.Domain)
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("resolve domain[%v] fail", request.Dest.Domain)
+		return nil, err
+	}
+	request.Dest.IP = ips[0]
+
+	sess.Logger.Debugf("resolve domain[%v] to ip%v success", request.Dest.Domain, ips)
+	return ips, nil
+}
+
+// lookup resolves name to at least one address.
+func (self *handler) lookup(sess *session.Session, name string) ([]net.IP, error) {
+	ips, err := self.resolver.Resolve(sess, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return ips, nil
+}
+
+func (self *handler) checkRules(sess *session.Session, request *proto.CommandRequest) error {
+	if self.rules == nil {
+		return nil
+	}
+
+	return self.applyRule(sess, request, self.rules.Evaluate(sess, request))
+}
 
-		ctx.Logger.Debugf("resolve domain[%v] to ip[%v] success", request.Dest.Domain, ip)
+func (self *handler) applyRule(sess *session.Session, request *proto.CommandRequest, matched *rule.Rule) error {
+	if matched.Action == rule.Deny {
+		sess.Logger.Warnf("request command:%v,%v denied by rule[%v]", request.Cmd, destString(request.Dest), matched.Name)
+		return ERR_RULE_DENIED
 	}
 
-	return self.HandleCommand(ctx, conn, request)
+	sess.Logger.Debugf("request command:%v,%v allowed by rule[%v]", request.Cmd, destString(request.Dest), matched.Name)
+	return nil
 }
 
-func (self *handler) HandleCommand(ctx *context.Context, conn net.Conn, request *proto.CommandRequest) error {
-	ctx.Logger.Debugf("handle request command:%v,%v:%v begin\n", request.Cmd, request.Dest.IP.String(), request.Dest.Port)
+func (self *handler) readRequest(sess *session.Session, conn net.Conn, request *proto.CommandRequest) error {
+	if sess.Version != proto.SOCKS4_VERSION {
+		return request.Read(conn)
+	}
+
+	req, err := proto.ReadSocks4Request(conn)
+	if err != nil {
+		return err
+	}
+
+	// USERID is only a claim, it is kept apart from authenticated names
+	identity := sess.Identity
+	if identity == nil {
+		identity = &session.Identity{Method: auth.MethodNoAuth}
+	}
+	if identity.Attributes == nil {
+		identity.Attributes = make(map[string]string)
+	}
+	identity.Attributes["userid"] = req.UserId
+	sess.SetIdentity(identity)
+
+	*request = proto.CommandRequest{Ver: req.Ver, Cmd: req.Cmd, Dest: req.Addr()}
+	return nil
+}
+
+func (self *handler) HandleCommand(sess *session.Session, conn net.Conn, request *proto.CommandRequest, ips []net.IP) error {
+	sess.Logger.Debugf("handle request command:%v,%v begin\n", request.Cmd, destString(request.Dest))
 	switch request.Cmd {
 	case proto.Connect:
-		return self.Connect(ctx, conn, request)
+		return self.Connect(sess, conn, request, ips)
 	case proto.Bind:
-		return self.Bind(ctx, conn, request)
+		return self.Bind(sess, conn, request, ips)
 	case proto.Associate:
-		return self.Associate(ctx, conn, request)
-	default:
-		self.SendReply(conn, proto.CommandNotSupport, proto.Addr{})
+		// SOCKS4 has no UDP relay
+		if sess.Version != proto.SOCKS4_VERSION {
+			return self.Associate(sess, conn, request)
+		}
 	}
 
+	self.SendReply(sess, conn, proto.CommandNotSupport, proto.Addr{})
 	repCode := proto.CommandNotSupport
 	return errors.New(repCode.String())
 }
 
-func (self *handler) SendReply(conn net.Conn, code proto.ReplyCode, addr proto.Addr) error {
-	reply := &proto.CommandReply{
+// SendReply answers the request in the client's SOCKS version.
+func (self *handler) SendReply(sess *session.Session, conn net.Conn, code proto.ReplyCode, addr proto.Addr) error {
+	if sess.Version == proto.SOCKS4_VERSION {
+		reply := &proto.Socks4Reply{
+			Ver:  proto.SOCKS4_REPLY_VERSION,
+			Code: proto.Socks4Rejected,
+			Port: addr.Port,
+			IP:   addr.IP,
+		}
+		if code == proto.Success {
+			reply.Code = proto.Socks4Granted
+		}
+
+		return proto.WriteSocks4Reply(conn, reply)
+	}
+
+	if addr.Type == 0 {
+		addr = proto.NewAddr(net.IPv4zero, 0)
+	}
+
+	reply := proto.CommandReply{
 		Ver: proto.VERSION,
 		Rep: byte(code),
 		Rsv: 0x00,
 		Bnd: addr,
 	}
 
-	return proto.WriteCommandReply(conn, reply)
+	return reply.Write(conn)
 }
 
-func (self *handler) Resolve(ctx sc.Context, name string) (net.IP, error) {
+// bndAddr is the address a reply reports for the local ip and port, the
+// listener's advertised address of the client's family when there is one.
+func bndAddr(sess *session.Session, ip net.IP, port int) proto.Addr {
+	advertise := sess.Advertise
+	if advertise == nil {
+		return proto.NewAddr(ip, port)
+	}
+
+	ipv4 := true
+	if tcpAddr, ok := sess.Conn.LocalAddr().(*net.TCPAddr); ok {
+		ipv4 = tcpAddr.IP.To4() != nil
+	}
+
+	if ipv4 && advertise.IPv4 != nil {
+		return proto.NewAddr(advertise.IPv4, port)
+	}
+
+	if !ipv4 && advertise.IPv6 != nil {
+		return proto.NewAddr(advertise.IPv6, port)
+	}
+
+	if advertise.Host != "" {
+		return proto.Addr{Type: proto.ATYP_DOMAIN, Domain: advertise.Host, Port: uint16(port)}
+	}
+
+	return proto.NewAddr(ip, port)
+}
+
+func (self *handler) Resolve(ctx sc.Context, name string) ([]net.IP, error) {
 	return self.resolver.Resolve(ctx, name)
 }
+
+func destString(addr proto.Addr) string {
+	host := addr.Domain
+	if host == "" {
+		host = addr.IP.String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(addr.Port)))
+}
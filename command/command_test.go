@@ -0,0 +1,228 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/rule"
+	"github.com/lkyzhu/socks5/session"
+)
+
+type staticResolver []net.IP
+
+func (self staticResolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	return self, nil
+}
+
+// newTestSession returns a session served on one end of a pipe and the
+// client's end.
+func newTestSession(t *testing.T) (*session.Session, net.Conn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	sess := session.NewSession(context.Background(), server)
+	t.Cleanup(sess.Close)
+	return sess, client
+}
+
+func TestRouteChecksEveryAddress(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	rules := rule.NewRuleset([]*rule.Rule{
+		{Name: "no-loopback", Action: rule.Deny, Networks: []*net.IPNet{loopback}},
+	}, rule.Allow)
+
+	tests := []struct {
+		name    string
+		ips     []net.IP
+		allowed []net.IP
+	}{
+		{"mixed", []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}, []net.IP{net.ParseIP("192.0.2.1")}},
+		{"denied first", []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("192.0.2.1")}, []net.IP{net.ParseIP("192.0.2.1")}},
+		{"all denied", []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(staticResolver(tt.ips), WithRuleset(rules)).(*handler)
+			request := &proto.CommandRequest{
+				Ver:  proto.VERSION,
+				Cmd:  proto.Connect,
+				Dest: proto.Addr{Type: proto.ATYP_DOMAIN, Domain: "example.test", Port: 80},
+			}
+
+			sess, _ := newTestSession(t)
+			ips, err := h.route(sess, request)
+			if tt.allowed == nil {
+				if !errors.Is(err, ERR_RULE_DENIED) {
+					t.Fatalf("route = %v, %v, want ERR_RULE_DENIED", ips, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("route: %v", err)
+			}
+			if len(ips) != len(tt.allowed) {
+				t.Fatalf("route = %v, want %v", ips, tt.allowed)
+			}
+			for i := range ips {
+				if !ips[i].Equal(tt.allowed[i]) {
+					t.Fatalf("route = %v, want %v", ips, tt.allowed)
+				}
+			}
+			if !request.Dest.IP.Equal(tt.allowed[0]) {
+				t.Fatalf("request ip = %v, want %v", request.Dest.IP, tt.allowed[0])
+			}
+		})
+	}
+}
+
+func TestForwardUDPChecksRules(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	allowed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+
+	denied, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+
+	deniedPort := uint16(denied.LocalAddr().(*net.UDPAddr).Port)
+	rules := rule.NewRuleset([]*rule.Rule{
+		{Name: "no-port", Action: rule.Deny, Ports: []rule.PortRange{{Min: deniedPort, Max: deniedPort}}},
+	}, rule.Allow)
+	h := NewHandler(staticResolver{net.IPv4(127, 0, 0, 1)}, WithRuleset(rules)).(*handler)
+	sess, _ := newTestSession(t)
+
+	send := func(port int, data string) {
+		packet, err := (&proto.UDPRequest{
+			Dest: proto.Addr{Type: proto.ATYP_DOMAIN, Domain: "example.test", Port: uint16(port)},
+			Data: []byte(data),
+		}).AppendBinary(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var request proto.UDPRequest
+		h.forwardUDP(sess, relay, &request, packet)
+	}
+
+	send(int(deniedPort), "denied")
+	send(allowed.LocalAddr().(*net.UDPAddr).Port, "allowed")
+
+	buf := make([]byte, 64)
+	allowed.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := allowed.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "allowed" {
+		t.Fatalf("allowed destination read %q, %v", buf[:n], err)
+	}
+
+	denied.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := denied.ReadFromUDP(buf); err == nil {
+		t.Fatalf("denied destination got %q", buf[:n])
+	}
+}
+
+func TestUnsupportedCommandIsAnswered(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		cmd     byte
+	}{
+		{"socks4 associate", proto.SOCKS4_VERSION, proto.Associate},
+		{"socks4 unknown", proto.SOCKS4_VERSION, 0x09},
+		{"socks5 unknown", proto.VERSION, 0x09},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(staticResolver(nil)).(*handler)
+			sess, peer := newTestSession(t)
+			sess.Version = tt.version
+
+			request := &proto.CommandRequest{Ver: tt.version, Cmd: tt.cmd, Dest: proto.NewAddr(net.IPv4(192, 0, 2, 1), 80)}
+			go h.HandleCommand(sess, sess.Conn, request, nil)
+
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			if tt.version == proto.SOCKS4_VERSION {
+				var reply proto.Socks4Reply
+				if err := reply.Read(peer); err != nil {
+					t.Fatal(err)
+				}
+				if reply.Code != proto.Socks4Rejected {
+					t.Fatalf("reply %+v, want rejected", reply)
+				}
+				return
+			}
+
+			reply, err := proto.ReadCommandReply(peer)
+			if err != nil || reply.Rep != byte(proto.CommandNotSupport) {
+				t.Fatalf("reply %+v, %v, want CommandNotSupport", reply, err)
+			}
+		})
+	}
+}
+
+func TestRelayUDPChecksRules(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	relay, client, allowed, denied := listen(), listen(), listen(), listen()
+
+	deniedPort := uint16(denied.LocalAddr().(*net.UDPAddr).Port)
+	rules := rule.NewRuleset([]*rule.Rule{
+		{Name: "no-port", Action: rule.Deny, Ports: []rule.PortRange{{Min: deniedPort, Max: deniedPort}}},
+	}, rule.Allow)
+	h := NewHandler(staticResolver(nil), WithRuleset(rules)).(*handler)
+	sess, _ := newTestSession(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.relayUDP(sess, relay, &udpClient{addr: client.LocalAddr().(*net.UDPAddr)})
+	}()
+	defer func() {
+		relay.Close()
+		<-done
+	}()
+
+	// the denied host goes first, only the allowed one reaches the client
+	denied.WriteToUDP([]byte("denied"), relay.LocalAddr().(*net.UDPAddr))
+	allowed.WriteToUDP([]byte("allowed"), relay.LocalAddr().(*net.UDPAddr))
+
+	buf := make([]byte, 512)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply proto.UDPRequest
+	if _, err := reply.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Data) != "allowed" || int(reply.Dest.Port) != allowed.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("client got %q from port %v", reply.Data, reply.Dest.Port)
+	}
+}
@@ -1,75 +1,33 @@
 package command
 
 import (
-	"io"
 	"net"
-	"strconv"
-	"sync"
 
-	"github.com/lkyzhu/socks5/internal/context"
-	"github.com/lkyzhu/socks5/internal/proto"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
 )
 
-func (self *handler) Connect(ctx *context.Context, conn net.Conn, request *proto.CommandRequest) error {
-	addr := net.JoinHostPort(request.Dest.IP.String(), strconv.Itoa(int(request.Dest.Port)))
-	dest, err := net.Dial("tcp", addr)
+func (self *handler) Connect(sess *session.Session, conn net.Conn, request *proto.CommandRequest, ips []net.IP) error {
+	dest, err := self.dial(sess, request, ips)
 	if err != nil {
-		ctx.Logger.WithError(err).Errorf("dial target[%v] fail", addr)
-
 		//send fail reply
-		rep := proto.PasreReplyCode(err.Error())
-		self.SendReply(conn, rep, proto.Addr{})
+		self.SendReply(sess, conn, proto.ReplyCodeFromError(err), proto.Addr{})
 		return err
 	}
 	defer dest.Close()
 
 	// send success reply
-	bnd := proto.Addr{
-		Type: proto.ATYP_IPV4,
-	}
+	var bnd proto.Addr
 	local := dest.LocalAddr()
 	if tcpAddr, ok := local.(*net.TCPAddr); ok {
-		bnd.IP = tcpAddr.IP
-		bnd.Port = uint16(tcpAddr.Port)
+		bnd = bndAddr(sess, tcpAddr.IP, tcpAddr.Port)
 	} else if udpAddr, ok := local.(*net.UDPAddr); ok {
-		bnd.IP = udpAddr.IP
-		bnd.Port = uint16(udpAddr.Port)
+		bnd = bndAddr(sess, udpAddr.IP, udpAddr.Port)
+	}
+	if err := self.SendReply(sess, conn, proto.Success, bnd); err != nil {
+		return err
 	}
-	self.SendReply(conn, proto.Success, bnd)
 
 	// start proxy
-	self.proxy(ctx, conn, dest)
-	return nil
-}
-
-func (self *handler) proxy(ctx *context.Context, src, dest net.Conn) {
-	wg := sync.WaitGroup{}
-
-	ctx.Logger.Debugf("start proxy[%v<-->%v]\n", src.RemoteAddr().String(), dest.RemoteAddr().String())
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		size, err := io.Copy(dest, src)
-		if err != nil {
-			ctx.Logger.WithError(err).Errorf("proxy[%v<-->%v] receive failed\n", src.RemoteAddr().String(), dest.RemoteAddr().String())
-			return
-		}
-		ctx.Logger.Debugf("proxy[%v<-->%v] receive data:%v\n", src.RemoteAddr().String(), dest.RemoteAddr().String(), size)
-
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		size, err := io.Copy(src, dest)
-		if err != nil {
-			ctx.Logger.WithError(err).Errorf("proxy[%v<-->%v] receive failed\n", src.RemoteAddr().String(), dest.RemoteAddr().String())
-			return
-		}
-		ctx.Logger.Debugf("proxy[%v<-->%v] receive data:%v\n", src.RemoteAddr().String(), dest.RemoteAddr().String(), size)
-	}()
-
-	wg.Wait()
-
-	ctx.Logger.Debugf("start proxy[%v<-->%v] end\n", src.RemoteAddr().String(), dest.RemoteAddr().String())
+	return self.proxy(sess, conn, dest).Err
 }
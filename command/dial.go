@@ -0,0 +1,213 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	sc "context"
+
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
+)
+
+const (
+	// the Connection Attempt Delay recommended by RFC 8305
+	defaultAttemptDelay = 250 * time.Millisecond
+)
+
+// WithPreferredFamily selects the family CONNECT tries first when the
+// destination has both, "ip4" or "ip6". IPv6 is preferred by default.
+func WithPreferredFamily(network string) Option {
+	return func(self *handler) {
+		self.preferredFamily = network
+	}
+}
+
+// WithAttemptDelay is how long CONNECT waits for one address before racing
+// the next one.
+func WithAttemptDelay(delay time.Duration) Option {
+	return func(self *handler) {
+		self.attemptDelay = delay
+	}
+}
+
+// DialError is returned when every address of a destination failed, it is
+// answered with HostUnreachable.
+type DialError struct {
+	Addrs []string
+	// Err is the error of the first address tried
+	Err error
+}
+
+func (self *DialError) Error() string {
+	return fmt.Sprintf("dial %v: all addresses failed, first: %v", self.Addrs, self.Err)
+}
+
+func (self *DialError) Unwrap() error {
+	return self.Err
+}
+
+func (self *DialError) ReplyCode() byte {
+	return byte(proto.HostUnreachable)
+}
+
+// dial connects to one of ips, or to the domain itself when the route left it
+// unresolved. With several addresses the attempts race as in RFC 8305 Happy
+// Eyeballs: families alternate, a new attempt starts when the previous one
+// fails or the attempt delay passes, the first connection wins.
+func (self *handler) dial(sess *session.Session, request *proto.CommandRequest, ips []net.IP) (net.Conn, error) {
+	ctx := sc.Context(sess)
+	if self.dialTimeout > 0 {
+		var cancel sc.CancelFunc
+		ctx, cancel = sc.WithTimeout(ctx, self.dialTimeout)
+		defer cancel()
+	}
+
+	port := strconv.Itoa(int(request.Dest.Port))
+	if len(ips) <= 1 {
+		host := request.Dest.Domain
+		if len(ips) == 1 {
+			host = ips[0].String()
+		}
+
+		addr := net.JoinHostPort(host, port)
+		dest, err := self.dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			sess.Logger.WithError(err).Errorf("dial target[%v] fail", addr)
+			return nil, err
+		}
+
+		return dest, nil
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range sortAddrs(ips, self.preferredFamily) {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+
+	dest, err := self.dialParallel(ctx, sess, addrs)
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("dial target[%v] fail", destString(request.Dest))
+
+		// running out of time is not the hosts' fault, it is answered TTLExpired
+		if errors.Is(ctx.Err(), sc.DeadlineExceeded) {
+			return nil, fmt.Errorf("dial %v: %w", destString(request.Dest), ctx.Err())
+		}
+		return nil, err
+	}
+
+	return dest, nil
+}
+
+func (self *handler) dialParallel(ctx sc.Context, sess *session.Session, addrs []string) (net.Conn, error) {
+	delay := self.attemptDelay
+	if delay == 0 {
+		delay = defaultAttemptDelay
+	}
+
+	ctx, cancel := sc.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+		addr string
+	}
+	results := make(chan result, len(addrs))
+
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := self.dialer.DialContext(ctx, "tcp", addr)
+			results <- result{conn: conn, err: err, addr: addr}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the losers still running are closed as they finish
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+
+			sess.Logger.WithError(r.err).Debugf("dial target[%v] fail", r.addr)
+			if firstErr == nil {
+				firstErr = r.err
+			}
+
+			// a failed attempt starts the next one at once
+			if next < len(addrs) {
+				start()
+				resetTimer(timer, delay)
+			}
+
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	return nil, &DialError{Addrs: addrs, Err: firstErr}
+}
+
+// sortAddrs interleaves the families starting with the preferred one, the
+// resolver's order is kept within a family.
+func sortAddrs(ips []net.IP, preferred string) []net.IP {
+	var ipv4, ipv6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+
+	first, second := ipv6, ipv4
+	if preferred == "ip4" {
+		first, second = ipv4, ipv6
+	}
+
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+
+	return sorted
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
@@ -0,0 +1,227 @@
+package command
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lkyzhu/socks5/internal/netutil"
+	"github.com/lkyzhu/socks5/limit"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
+)
+
+// HTTPHandler is implemented by handlers that also serve HTTP proxy requests
+// arriving on the SOCKS port, the request has already been authenticated.
+type HTTPHandler interface {
+	ProcessHTTP(sess *session.Session, conn net.Conn, req *http.Request) error
+}
+
+// Hop-by-hop headers, these are removed when forwarding.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func (self *handler) ProcessHTTP(sess *session.Session, conn net.Conn, req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		return self.httpConnect(sess, conn, req)
+	}
+
+	return self.httpForward(sess, conn, req)
+}
+
+func (self *handler) httpConnect(sess *session.Session, conn net.Conn, req *http.Request) error {
+	request, err := httpRequest(req.Host, "443")
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest)
+		return err
+	}
+
+	dest, err := self.httpDial(sess, request)
+	if err != nil {
+		writeHTTPError(conn, httpStatus(err))
+		return err
+	}
+	defer dest.Close()
+
+	if _, err := fmt.Fprintf(conn, "HTTP/%d.%d 200 Connection established\r\n\r\n", req.ProtoMajor, req.ProtoMinor); err != nil {
+		return err
+	}
+
+	return self.proxy(sess, conn, dest).Err
+}
+
+// httpForward serves absolute-URI requests, keeping one upstream connection
+// for as long as the client stays on the same host.
+func (self *handler) httpForward(sess *session.Session, conn net.Conn, req *http.Request) error {
+	// keep reading through the session's buffer when there is one
+	var client io.Reader = conn
+	if buffered, ok := conn.(*netutil.BufferedConn); ok {
+		client = buffered.Reader
+	}
+
+	// what the client and the origin send is charged as in a relay, the
+	// first request's body is still in the session's buffer
+	upload, download := self.limiters(sess)
+	reader := bufio.NewReader(self.httpReader(sess, conn, client, upload))
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = readCloser{Reader: self.httpReader(sess, conn, req.Body, upload), Closer: req.Body}
+	}
+
+	var dest net.Conn
+	var destReader *bufio.Reader
+	var destHost string
+	defer func() {
+		if dest != nil {
+			dest.Close()
+		}
+	}()
+
+	for {
+		if req.URL.Host == "" || req.URL.Scheme != "http" {
+			writeHTTPError(conn, http.StatusBadRequest)
+			return fmt.Errorf("not a proxy request:%v", req.URL.String())
+		}
+
+		if dest == nil || destHost != req.URL.Host {
+			if dest != nil {
+				dest.Close()
+				dest = nil
+			}
+
+			request, err := httpRequest(req.URL.Host, "80")
+			if err != nil {
+				writeHTTPError(conn, http.StatusBadRequest)
+				return err
+			}
+
+			dest, err = self.httpDial(sess, request)
+			if err != nil {
+				writeHTTPError(conn, httpStatus(err))
+				return err
+			}
+			destReader = bufio.NewReader(self.httpReader(sess, dest, dest, download))
+			destHost = req.URL.Host
+		}
+
+		removeHopHeaders(req.Header)
+		if err := req.Write(dest); err != nil {
+			sess.Logger.WithError(err).Errorf("forward request to [%v] fail", destHost)
+			writeHTTPError(conn, http.StatusBadGateway)
+			return err
+		}
+
+		resp, err := http.ReadResponse(destReader, req)
+		if err != nil {
+			sess.Logger.WithError(err).Errorf("read response from [%v] fail", destHost)
+			writeHTTPError(conn, http.StatusBadGateway)
+			return err
+		}
+
+		removeHopHeaders(resp.Header)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		sess.Logger.Debugf("forward %v %v:%v", req.Method, req.URL.String(), resp.StatusCode)
+
+		if req.Close || resp.Close {
+			return nil
+		}
+
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// httpReader reads r, the client or the origin side of forwarded requests,
+// charged to limiters. Every read of r waits on conn for the idle timeout at
+// most, a keep-alive client or an origin going quiet ends the session.
+func (self *handler) httpReader(sess *session.Session, conn net.Conn, r io.Reader, limiters []*limit.Limiter) io.Reader {
+	if self.idleTimeout > 0 {
+		r = &idleReader{Reader: r, conn: conn, timeout: self.idleTimeout}
+	}
+
+	return limit.NewReader(sess, r, limiters...)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// httpDial sends an HTTP proxy request through the same resolver, rules and
+// dialer as a SOCKS CONNECT.
+func (self *handler) httpDial(sess *session.Session, request *proto.CommandRequest) (net.Conn, error) {
+	ips, err := self.route(sess, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.dial(sess, request, ips)
+}
+
+func httpRequest(hostport string, defPort string) (*proto.CommandRequest, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, portStr = strings.Trim(hostport, "[]"), defPort
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := proto.Addr{Type: proto.ATYP_DOMAIN, Domain: host, Port: uint16(port)}
+	if ip := net.ParseIP(host); ip != nil {
+		dest = proto.NewAddr(ip, int(port))
+	}
+
+	return &proto.CommandRequest{Ver: proto.VERSION, Cmd: proto.Connect, Dest: dest}, nil
+}
+
+func httpStatus(err error) int {
+	if errors.Is(err, ERR_RULE_DENIED) {
+		return http.StatusForbidden
+	}
+
+	if proto.ReplyCodeFromError(err) == proto.TTLExpired {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+func writeHTTPError(conn net.Conn, status int) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+	return err
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
@@ -0,0 +1,106 @@
+package command
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lkyzhu/socks5/limit"
+)
+
+func TestHTTPForwardChargesBandwidth(t *testing.T) {
+	body := strings.Repeat("x", 64*1024)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+
+	// a full bucket pays for the first half, the second half takes a second
+	h := NewHandler(staticResolver(nil), WithBandwidth(limit.NewBandwidth(0, 32*1024))).(*handler)
+	sess, peer := newTestSession(t)
+
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET " + origin.URL + "/ HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() + "\r\nConnection: close\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ProcessHTTP(sess, sess.Conn, req)
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(peer), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil || len(got) != len(body) {
+		t.Fatalf("read %v bytes, %v, want %v", len(got), err, len(body))
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ProcessHTTP: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("forwarded in %v, the download limit was not applied", elapsed)
+	}
+}
+
+func TestHTTPForwardIdleTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		// the client keeps the connection and never sends another request
+		{"keep-alive client", "/", http.StatusOK},
+		// the origin takes the request and never answers
+		{"quiet origin", "/hang", http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(staticResolver(nil), WithIdleTimeout(200*time.Millisecond)).(*handler)
+			sess, peer := newTestSession(t)
+
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET " + origin.URL + tt.path + " HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() + "\r\n\r\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- h.ProcessHTTP(sess, sess.Conn, req)
+			}()
+
+			resp, err := http.ReadResponse(bufio.NewReader(peer), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %v, want %v", resp.StatusCode, tt.status)
+			}
+			io.Copy(io.Discard, resp.Body)
+
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("forwarding outlived the idle timeout")
+			}
+		})
+	}
+}
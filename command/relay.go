@@ -0,0 +1,360 @@
+package command
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	sc "context"
+
+	"github.com/lkyzhu/socks5/internal/netutil"
+	"github.com/lkyzhu/socks5/limit"
+	"github.com/lkyzhu/socks5/session"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	relayBufferSize = 32 * 1024
+)
+
+// Side is one end of a relay.
+type Side byte
+
+const (
+	SideClient Side = iota + 1
+	SideDest
+)
+
+func (self Side) String() string {
+	switch self {
+	case SideClient:
+		return "client"
+	case SideDest:
+		return "dest"
+	}
+
+	return "none"
+}
+
+// RelayResult describes a finished relay.
+type RelayResult struct {
+	// Upload is what the client sent to the destination, Download what it
+	// got back, in bytes
+	Upload   int64
+	Download int64
+	Duration time.Duration
+
+	// ClosedFirst is the side that stopped sending, or failed, first. It
+	// is zero when the relay went idle before either side closed.
+	ClosedFirst Side
+
+	// Err ended the relay, nil when both sides closed cleanly and
+	// ERR_RELAY_IDLE when neither moved a byte for the idle timeout
+	Err error
+}
+
+// proxy relays between the client src and dest until both directions end. A
+// side that stops sending is half-closed towards the other, which reads EOF
+// and may still answer. A hard error in either direction ends both.
+// Directions between plain TCP conns with no limits to apply are spliced by
+// the kernel, the others copy through pooled buffers.
+func (self *handler) proxy(sess *session.Session, src, dest net.Conn) *RelayResult {
+	upload, download := self.limiters(sess)
+
+	var idle *idleTimer
+	if self.idleTimeout > 0 {
+		idle = newIdleTimer(self.idleTimeout)
+	}
+
+	// closing the conns is what unblocks the direction still running
+	ctx, cancel := sc.WithCancel(sess)
+	defer cancel()
+	stop := sc.AfterFunc(ctx, func() {
+		src.Close()
+		dest.Close()
+	})
+	defer stop()
+
+	sess.Logger.Debugf("start proxy[%v<-->%v]", src.RemoteAddr().String(), dest.RemoteAddr().String())
+
+	result := &RelayResult{}
+	var lock sync.Mutex
+	finish := func(side Side, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		// an idle relay is closed by the cancel, not by either side
+		if result.Err == ERR_RELAY_IDLE {
+			return
+		}
+		if err == ERR_RELAY_IDLE {
+			if ctx.Err() == nil {
+				result.Err = err
+				cancel()
+			}
+			return
+		}
+
+		if result.ClosedFirst == 0 {
+			result.ClosedFirst = side
+		}
+
+		// errors after the relay was canceled are the cancel's doing
+		if err != nil && ctx.Err() == nil {
+			result.Err = err
+			cancel()
+		}
+	}
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.Upload = relayHalf(ctx, finish, idle, dest, src, upload, SideClient)
+	}()
+	go func() {
+		defer wg.Done()
+		result.Download = relayHalf(ctx, finish, idle, src, dest, download, SideDest)
+	}()
+	wg.Wait()
+
+	result.Duration = time.Since(start)
+	if result.Err == nil {
+		result.Err = sess.Err()
+	}
+
+	logger := sess.Logger.WithFields(logrus.Fields{
+		"upload":   result.Upload,
+		"download": result.Download,
+		"duration": result.Duration,
+	})
+	if result.Err == ERR_RELAY_IDLE {
+		logger.Debugf("proxy[%v<-->%v] end, idle for %v", src.RemoteAddr().String(), dest.RemoteAddr().String(), self.idleTimeout)
+	} else if result.Err != nil {
+		logger.WithError(result.Err).Errorf("proxy[%v<-->%v] end, %v failed first", src.RemoteAddr().String(), dest.RemoteAddr().String(), result.ClosedFirst)
+	} else {
+		logger.Debugf("proxy[%v<-->%v] end, %v closed first", src.RemoteAddr().String(), dest.RemoteAddr().String(), result.ClosedFirst)
+	}
+
+	return result
+}
+
+// relayBuffers are shared by the relays that have to see the bytes they move.
+var relayBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// relayHalf copies what from sends on src to dst, charged to limiters. When
+// from stops sending dst is half-closed, conns that can not half-close stay
+// open until the other direction ends too.
+func relayHalf(ctx sc.Context, finish func(Side, error), idle *idleTimer, dst, src net.Conn, limiters []*limit.Limiter, from Side) int64 {
+	to := SideDest
+	if from == SideDest {
+		to = SideClient
+	}
+
+	if len(limiters) == 0 {
+		if written, ok := spliceHalf(finish, idle, dst, src, from, to); ok {
+			return written
+		}
+	}
+
+	size := relayBufferSize
+	if len(limiters) > 0 {
+		size = limit.MaxChunk
+	}
+
+	reader := newReadyReader(src, size)
+	var written int64
+	for {
+		stall := idle.arm(src, dst)
+
+		buf, n, rerr := reader.read()
+		if n > 0 {
+			if len(limiters) > 0 {
+				// waiting for tokens is not idling, and the wait does not
+				// count against dst
+				idle.hold()
+				err := limit.WaitN(ctx, n, limiters...)
+				idle.release()
+				if err != nil {
+					relayBuffers.Put(buf)
+					finish(from, err)
+					return written
+				}
+				stall = idle.armWrite(dst, time.Now())
+			} else {
+				idle.touch()
+			}
+
+			m, werr := dst.Write((*buf)[:n])
+			relayBuffers.Put(buf)
+			written += int64(m)
+			if werr == nil && m < n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				finish(to, idle.expired(werr))
+				return written
+			}
+		}
+
+		if rerr == io.EOF {
+			finish(from, nil)
+			netutil.CloseWrite(dst)
+			return written
+		}
+		if rerr != nil {
+			if idle.wake(rerr, stall) {
+				continue
+			}
+
+			finish(from, idle.expired(rerr))
+			return written
+		}
+	}
+}
+
+// readyReader reads src into a pool buffer taken only once src is readable,
+// so a direction waiting for its peer holds none. A conn that can not be
+// waited on gives a first byte, the rest of what it holds is read under an
+// expired deadline so that the read does not block.
+type readyReader struct {
+	src  net.Conn
+	size int
+
+	// bytes the handshake buffered ahead of the socket
+	buffered *bufio.Reader
+	waiter   *readWaiter
+	first    [1]byte
+}
+
+func newReadyReader(src net.Conn, size int) *readyReader {
+	r := &readyReader{src: src, size: size}
+
+	conn := src
+	if buffered, ok := src.(*netutil.BufferedConn); ok {
+		r.buffered = buffered.Reader
+		conn = buffered.Conn
+	}
+	r.waiter = newReadWaiter(conn)
+
+	return r
+}
+
+// read returns the buffer holding what it read, nil when it read nothing.
+func (self *readyReader) read() (*[]byte, int, error) {
+	if self.waiter != nil {
+		if self.buffered == nil || self.buffered.Buffered() == 0 {
+			if err := self.waiter.wait(); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		buf := relayBuffers.Get().(*[]byte)
+		n, err := self.src.Read((*buf)[:self.size])
+		if n == 0 {
+			relayBuffers.Put(buf)
+			return nil, 0, err
+		}
+		return buf, n, err
+	}
+
+	n, err := self.src.Read(self.first[:])
+	if n == 0 {
+		return nil, 0, err
+	}
+
+	buf := relayBuffers.Get().(*[]byte)
+	(*buf)[0] = self.first[0]
+	if err == nil && self.size > 1 {
+		self.src.SetReadDeadline(time.Now())
+		n, err = self.src.Read((*buf)[1:self.size])
+		n++
+		self.src.SetReadDeadline(time.Time{})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = nil
+		}
+	}
+
+	return buf, n, err
+}
+
+// spliceHalf is relayHalf between two plain TCP conns, nothing in between
+// needs the bytes so the kernel moves them without copying them through user
+// space. It reports false, having done nothing, for any other conns.
+func spliceHalf(finish func(Side, error), idle *idleTimer, dst, src net.Conn, from, to Side) (int64, bool) {
+	// bytes the handshake buffered ahead of the relay go first
+	var pending *bufio.Reader
+	if buffered, ok := src.(*netutil.BufferedConn); ok {
+		pending = buffered.Reader
+		src = buffered.Conn
+	}
+
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		if buffered, isBuffered := dst.(*netutil.BufferedConn); isBuffered {
+			dstTCP, ok = buffered.Conn.(*net.TCPConn)
+		}
+		if !ok {
+			return 0, false
+		}
+	}
+
+	var written int64
+	if pending != nil && pending.Buffered() > 0 {
+		b, _ := pending.Peek(pending.Buffered())
+		m, err := dstTCP.Write(b)
+		written += int64(m)
+		pending.Discard(m)
+		if err != nil {
+			finish(to, err)
+			return written, true
+		}
+	}
+
+	// a wake up interrupts the splice between two reads, nothing is lost
+	for {
+		stall := idle.arm(srcTCP, dstTCP)
+
+		n, err := dstTCP.ReadFrom(srcTCP)
+		written += n
+		if n > 0 {
+			idle.touch()
+		}
+
+		if err == nil {
+			finish(from, nil)
+			dstTCP.CloseWrite()
+			return written, true
+		}
+		if idle.wake(err, stall) {
+			continue
+		}
+		if err = idle.expired(err); err == ERR_RELAY_IDLE {
+			finish(from, err)
+			return written, true
+		}
+
+		// splice does not tell which end failed, a broken pipe is the writer's
+		side := from
+		if errors.Is(err, syscall.EPIPE) {
+			side = to
+		}
+		finish(side, err)
+		return written, true
+	}
+}
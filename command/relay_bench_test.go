@@ -0,0 +1,291 @@
+//go:build linux
+
+package command
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lkyzhu/socks5/limit"
+	"github.com/lkyzhu/socks5/session"
+)
+
+// go test ./command -run - -bench RelaySessions -benchtime 1x
+var benchSessions = flag.Int("relay.sessions", 10000, "sessions opened by BenchmarkRelaySessions")
+
+const (
+	// descriptors a relayed session holds: both peers, the relay's two conns
+	// and a splice pipe for each blocked direction
+	fdsPerSession = 8
+)
+
+// relayPair is a relay in progress between a client and a destination.
+type relayPair struct {
+	client net.Conn
+	dest   net.Conn
+	done   chan *RelayResult
+}
+
+func (self *relayPair) close() *RelayResult {
+	self.client.Close()
+	self.dest.Close()
+	return <-self.done
+}
+
+type relayBench struct {
+	handler  *handler
+	client   net.Listener
+	dest     net.Listener
+	sessions []*session.Session
+}
+
+// newRelayBench relays through a handler with opts, a pooled relay when the
+// handler has limiters and a spliced one when it has none.
+func newRelayBench(b *testing.B, opts ...Option) *relayBench {
+	client, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		client.Close()
+		dest.Close()
+	})
+
+	return &relayBench{
+		handler: NewHandler(staticResolver(nil), opts...).(*handler),
+		client:  client,
+		dest:    dest,
+	}
+}
+
+// dial opens the four conns of a session, the relay is not started yet.
+func (self *relayBench) dial() (clientPeer, relayClient, relayDest, destPeer net.Conn, err error) {
+	if clientPeer, err = net.Dial("tcp", self.client.Addr().String()); err != nil {
+		return
+	}
+	if relayClient, err = self.client.Accept(); err != nil {
+		return
+	}
+	if relayDest, err = net.Dial("tcp", self.dest.Addr().String()); err != nil {
+		return
+	}
+	destPeer, err = self.dest.Accept()
+	return
+}
+
+func (self *relayBench) start(clientPeer, relayClient, relayDest, destPeer net.Conn) *relayPair {
+	sess := session.NewSession(context.Background(), relayClient)
+	self.sessions = append(self.sessions, sess)
+
+	pair := &relayPair{client: clientPeer, dest: destPeer, done: make(chan *RelayResult, 1)}
+	go func() {
+		pair.done <- self.handler.proxy(sess, relayClient, relayDest)
+	}()
+
+	return pair
+}
+
+func benchmarkRelayThroughput(b *testing.B, opts ...Option) {
+	bench := newRelayBench(b, opts...)
+	clientPeer, relayClient, relayDest, destPeer, err := bench.dial()
+	if err != nil {
+		b.Fatal(err)
+	}
+	pair := bench.start(clientPeer, relayClient, relayDest, destPeer)
+
+	chunk := make([]byte, 128*1024)
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, pair.dest)
+		received <- n
+	}()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pair.client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	pair.client.(*net.TCPConn).CloseWrite()
+	n := <-received
+	b.StopTimer()
+
+	if want := int64(b.N) * int64(len(chunk)); n != want {
+		b.Fatalf("relayed %v bytes, want %v", n, want)
+	}
+	pair.close()
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelayThroughput(b)
+}
+
+func BenchmarkRelayPooled(b *testing.B) {
+	// unlimited buckets still make the relay read the bytes
+	benchmarkRelayThroughput(b, WithBandwidth(limit.NewBandwidth(0, 0)))
+}
+
+// BenchmarkRelaySessions reports the memory the relay itself takes per
+// session, conns excluded, with all sessions open at once. Idle sessions
+// never moved a byte, active ones did a round trip just before measuring.
+func BenchmarkRelaySessions(b *testing.B) {
+	modes := []struct {
+		name string
+		opts []Option
+	}{
+		{"splice", nil},
+		{"pooled", []Option{WithBandwidth(limit.NewBandwidth(0, 0))}},
+	}
+
+	for _, mode := range modes {
+		for _, active := range []bool{false, true} {
+			name := mode.name + "/idle"
+			if active {
+				name = mode.name + "/active"
+			}
+
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					benchmarkRelaySessions(b, sessionCount(b), active, mode.opts...)
+				}
+			})
+		}
+	}
+}
+
+func benchmarkRelaySessions(b *testing.B, n int, active bool, opts ...Option) {
+	bench := newRelayBench(b, opts...)
+
+	type conns struct {
+		clientPeer, relayClient, relayDest, destPeer net.Conn
+	}
+	pending := make([]conns, 0, n)
+	for i := 0; i < n; i++ {
+		var c conns
+		var err error
+		if c.clientPeer, c.relayClient, c.relayDest, c.destPeer, err = bench.dial(); err != nil {
+			b.Fatal(err)
+		}
+		pending = append(pending, c)
+	}
+
+	before := settledMemory()
+
+	pairs := make([]*relayPair, 0, n)
+	for _, c := range pending {
+		pairs = append(pairs, bench.start(c.clientPeer, c.relayClient, c.relayDest, c.destPeer))
+	}
+
+	if active {
+		roundTrips(b, pairs)
+	}
+
+	after := settledMemory()
+	b.ReportMetric(float64(after.heap-before.heap)/float64(n), "heap-B/session")
+	b.ReportMetric(float64(after.stack-before.stack)/float64(n), "stack-B/session")
+	b.ReportMetric(float64(n), "sessions")
+
+	for _, pair := range pairs {
+		pair.close()
+	}
+	for _, sess := range bench.sessions {
+		sess.Close()
+	}
+}
+
+// roundTrips moves 4 KiB each way through every session.
+func roundTrips(b *testing.B, pairs []*relayPair) {
+	msg := make([]byte, 4096)
+	work := make(chan *relayPair)
+	errs := make(chan error, len(pairs))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 64; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(msg))
+			for pair := range work {
+				if err := roundTrip(pair, msg, buf); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	for _, pair := range pairs {
+		work <- pair
+	}
+	close(work)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		b.Fatal(err)
+	default:
+	}
+}
+
+func roundTrip(pair *relayPair, msg, buf []byte) error {
+	if _, err := pair.client.Write(msg); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(pair.dest, buf); err != nil {
+		return err
+	}
+	if _, err := pair.dest.Write(msg); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(pair.client, buf)
+	return err
+}
+
+type memory struct {
+	heap  uint64
+	stack uint64
+}
+
+// settledMemory measures once the relays are blocked and garbage collected.
+func settledMemory() memory {
+	time.Sleep(200 * time.Millisecond)
+	runtime.GC()
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return memory{heap: stats.HeapInuse, stack: stats.StackInuse}
+}
+
+// sessionCount is -relay.sessions, fewer when the open files limit can not
+// hold them.
+func sessionCount(b *testing.B) int {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		b.Fatal(err)
+	}
+	if rlimit.Cur < rlimit.Max {
+		rlimit.Cur = rlimit.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit)
+	}
+
+	n := *benchSessions
+	if max := int(rlimit.Cur-64) / fdsPerSession; n > max {
+		b.Logf("open files limit %v holds %v of %v sessions", rlimit.Cur, max, n)
+		n = max
+	}
+
+	return n
+}
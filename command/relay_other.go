@@ -0,0 +1,19 @@
+//go:build !unix
+
+package command
+
+import (
+	"net"
+)
+
+type readWaiter struct{}
+
+// newReadWaiter has no way to wait for a socket here, the relay reads a first
+// byte instead.
+func newReadWaiter(conn net.Conn) *readWaiter {
+	return nil
+}
+
+func (self *readWaiter) wait() error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package command
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lkyzhu/socks5/limit"
+)
+
+// startRelay relays between the ends of two pipes, it returns the client's
+// and the destination's peers.
+func startRelay(t *testing.T, h *handler) (client, dest net.Conn, done chan *RelayResult) {
+	client, relayClient := net.Pipe()
+	relayDest, dest := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		dest.Close()
+	})
+
+	sess, _ := newTestSession(t)
+	done = make(chan *RelayResult, 1)
+	go func() {
+		done <- h.proxy(sess, relayClient, relayDest)
+	}()
+
+	return client, dest, done
+}
+
+func TestRelayBandwidthWaitIsNotIdle(t *testing.T) {
+	// every chunk waits a second for tokens, longer than the idle timeout
+	h := NewHandler(staticResolver(nil), WithIdleTimeout(400*time.Millisecond), WithBandwidth(limit.NewBandwidth(0, 16*1024))).(*handler)
+	client, dest, done := startRelay(t, h)
+
+	data := make([]byte, 48*1024)
+	go func() {
+		dest.Write(data)
+		dest.Close()
+	}()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, make([]byte, len(data))); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	client.Close()
+
+	result := <-done
+	if result.Err != nil || result.Download != int64(len(data)) {
+		t.Fatalf("result %+v", result)
+	}
+}
+
+func TestRelayIdleResult(t *testing.T) {
+	h := NewHandler(staticResolver(nil), WithIdleTimeout(200*time.Millisecond), WithBandwidth(limit.NewBandwidth(0, 0))).(*handler)
+	_, _, done := startRelay(t, h)
+
+	select {
+	case result := <-done:
+		if result.Err != ERR_RELAY_IDLE || result.ClosedFirst != 0 {
+			t.Fatalf("result %+v, want ERR_RELAY_IDLE closed by neither side", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle relay still running")
+	}
+}
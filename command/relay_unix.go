@@ -0,0 +1,41 @@
+//go:build unix
+
+package command
+
+import (
+	"net"
+	"syscall"
+)
+
+// readWaiter waits for a socket to have bytes, or an error, to read without
+// taking them.
+type readWaiter struct {
+	raw   syscall.RawConn
+	peek  [1]byte
+	ready func(fd uintptr) bool
+}
+
+// newReadWaiter returns nil for conns that are not sockets.
+func newReadWaiter(conn net.Conn) *readWaiter {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	w := &readWaiter{raw: raw}
+	w.ready = func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), w.peek[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return err != syscall.EAGAIN
+	}
+	return w
+}
+
+// wait blocks until the socket is readable, under its read deadline.
+func (self *readWaiter) wait() error {
+	return self.raw.Read(self.ready)
+}
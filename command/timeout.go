@@ -0,0 +1,133 @@
+package command
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ERR_RELAY_IDLE = errors.New("relay idle timeout")
+)
+
+// WithDialTimeout bounds how long CONNECT tries to reach its destination, all
+// of its addresses together.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(self *handler) {
+		self.dialTimeout = timeout
+	}
+}
+
+// WithIdleTimeout ends a relay after timeout without traffic in either
+// direction, noticed within half a timeout more, and bounds the wait for the
+// command request.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(self *handler) {
+		self.idleTimeout = timeout
+	}
+}
+
+// idleTimer is the last activity of a relay, shared by both directions so a
+// quiet direction is kept open while the other one moves. The bytes do not
+// pass through it: the directions wake up every half timeout to report what
+// they moved, which keeps the kernel splice path open. A nil idleTimer never
+// expires.
+type idleTimer struct {
+	timeout time.Duration
+	last    atomic.Int64
+
+	// directions waiting for bandwidth, the relay is active meanwhile
+	held atomic.Int32
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (self *idleTimer) touch() {
+	if self != nil {
+		self.last.Store(time.Now().UnixNano())
+	}
+}
+
+// hold keeps the relay active until release, for a direction that has bytes
+// but has to wait before sending them.
+func (self *idleTimer) hold() {
+	if self != nil {
+		self.touch()
+		self.held.Add(1)
+	}
+}
+
+func (self *idleTimer) release() {
+	if self != nil {
+		self.held.Add(-1)
+		self.touch()
+	}
+}
+
+// arm sets the deadlines of a direction's next transfer from src to dst. The
+// read deadline is the wake up, the write deadline only passes when dst took
+// nothing for a whole timeout. It returns the write deadline.
+func (self *idleTimer) arm(src, dst net.Conn) time.Time {
+	if self == nil {
+		return time.Time{}
+	}
+
+	wake := time.Now().Add(self.timeout / 2)
+	src.SetReadDeadline(wake)
+	return self.armWrite(dst, wake)
+}
+
+// armWrite gives dst a timeout from start to take the next write.
+func (self *idleTimer) armWrite(dst net.Conn, start time.Time) time.Time {
+	if self == nil {
+		return time.Time{}
+	}
+
+	stall := start.Add(self.timeout)
+	dst.SetWriteDeadline(stall)
+	return stall
+}
+
+// wake reports whether err is only the wake up of arm, with the relay still
+// active and the direction to go on.
+func (self *idleTimer) wake(err error, stall time.Time) bool {
+	if self == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+
+	now := time.Now()
+	if !now.Before(stall) {
+		return false
+	}
+
+	return self.held.Load() > 0 || now.Sub(time.Unix(0, self.last.Load())) < self.timeout
+}
+
+// expired turns a deadline error that is not a wake up into ERR_RELAY_IDLE,
+// the relay as a whole timed out rather than the side that noticed.
+func (self *idleTimer) expired(err error) error {
+	if self != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		return ERR_RELAY_IDLE
+	}
+
+	return err
+}
+
+// idleReader gives every read of conn, through Reader, the idle timeout.
+type idleReader struct {
+	io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (self *idleReader) Read(b []byte) (int, error) {
+	self.conn.SetReadDeadline(time.Now().Add(self.timeout))
+	return self.Reader.Read(b)
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/lkyzhu/socks5"
 	"github.com/lkyzhu/socks5/auth"
 	"github.com/lkyzhu/socks5/command"
+	"github.com/lkyzhu/socks5/limit"
 	"github.com/lkyzhu/socks5/resolve"
+	"github.com/lkyzhu/socks5/session"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -19,6 +25,15 @@ func main() {
 	}
 
 	cmd.Flags().String("addr", "", "addr to listen")
+	cmd.Flags().StringSlice("nameserver", nil, "dns servers to resolve through instead of the system resolver")
+	cmd.Flags().Int("max-sessions", 1024, "concurrent sessions, 0 for unlimited")
+	cmd.Flags().Int("max-sessions-per-ip", 0, "concurrent sessions of one client ip, 0 for unlimited")
+	cmd.Flags().Int("max-sessions-per-user", 0, "concurrent sessions of one user, 0 for unlimited")
+	cmd.Flags().StringSlice("advertise", nil, "public ip or host name reported in replies")
+	cmd.Flags().Duration("handshake-timeout", 10*time.Second, "time allowed for greeting and authentication, 0 for none")
+	cmd.Flags().Duration("dial-timeout", 30*time.Second, "time allowed to reach a destination, 0 for none")
+	cmd.Flags().Duration("idle-timeout", 5*time.Minute, "time a relay may go without traffic, 0 for none")
+	cmd.Flags().Duration("max-session-lifetime", 0, "longest a session may last, 0 for unlimited")
 	cmd.Execute()
 }
 
@@ -34,30 +49,74 @@ func run(cmd *cobra.Command, args []string) {
 	noAuth := auth.NewNoAuthAuthenticator()
 	authMgr.Regist(noAuth)
 
-	handler := command.NewHandler(resolve.NewResolver())
-	server := socks5.NewServer(authMgr, handler)
+	var upstream resolve.Resolver
+	if nameservers, _ := cmd.Flags().GetStringSlice("nameserver"); len(nameservers) > 0 {
+		upstream = resolve.NewDNSResolver(nameservers)
+	}
+
+	dialTimeout, _ := cmd.Flags().GetDuration("dial-timeout")
+	idleTimeout, _ := cmd.Flags().GetDuration("idle-timeout")
+	handler := command.NewHandler(resolve.NewStack(upstream), command.WithDialTimeout(dialTimeout), command.WithIdleTimeout(idleTimeout))
+
+	limits := limit.SessionLimits{}
+	limits.Total, _ = cmd.Flags().GetInt("max-sessions")
+	limits.PerIP, _ = cmd.Flags().GetInt("max-sessions-per-ip")
+	limits.PerUser, _ = cmd.Flags().GetInt("max-sessions-per-user")
+
+	handshakeTimeout, _ := cmd.Flags().GetDuration("handshake-timeout")
+	lifetime, _ := cmd.Flags().GetDuration("max-session-lifetime")
+	server := socks5.NewServer(authMgr, handler,
+		socks5.WithSessionLimits(limit.NewSessions(limits)),
+		socks5.WithHandshakeTimeout(handshakeTimeout),
+		socks5.WithMaxSessionLifetime(lifetime),
+	)
 
 	addr, err := cmd.Flags().GetString("addr")
 	if err != nil {
 		return
 	}
 
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		logrus.WithError(err).Errorf("listen addr[%v] fail", addr)
-		return
+	var opts []socks5.ListenerOption
+	if advertise, _ := cmd.Flags().GetStringSlice("advertise"); len(advertise) > 0 {
+		opts = append(opts, socks5.WithAdvertise(parseAdvertise(advertise)))
 	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			logrus.WithError(err).Errorf("accept for [%v] fail", addr)
-			return
+	idle := make(chan struct{})
+	go func() {
+		defer close(idle)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Errorf("shutdown fail")
 		}
+	}()
 
-		logrus.Debugf("receive conn:%v\n", conn.RemoteAddr().String())
+	if err := server.ListenAndServe("tcp", addr, opts...); err != socks5.ERR_SERVER_CLOSED {
+		logrus.WithError(err).Errorf("serve addr[%v] fail", addr)
+		return
+	}
 
-		go server.ServeConn(conn)
+	<-idle
+}
 
+func parseAdvertise(addrs []string) session.Advertise {
+	advertise := session.Advertise{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+			advertise.Host = addr
+		case ip.To4() != nil:
+			advertise.IPv4 = ip
+		default:
+			advertise.IPv6 = ip
+		}
 	}
+
+	return advertise
 }
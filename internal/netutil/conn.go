@@ -0,0 +1,42 @@
+package netutil
+
+import (
+	"bufio"
+	"errors"
+	"net"
+)
+
+// BufferedConn is a net.Conn whose reads drain a bufio.Reader first, so bytes
+// buffered while parsing a handshake are not lost.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func NewBufferedConn(conn net.Conn, reader *bufio.Reader) *BufferedConn {
+	return &BufferedConn{
+		Conn:   conn,
+		Reader: reader,
+	}
+}
+
+func (self *BufferedConn) Read(b []byte) (int, error) {
+	return self.Reader.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the underlying conn, the
+// buffered reads go on.
+func (self *BufferedConn) CloseWrite() error {
+	return CloseWrite(self.Conn)
+}
+
+// CloseWrite shuts down the writing side of conn, the peer reads EOF while
+// conn can still read. Conns that can not half-close return
+// errors.ErrUnsupported.
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.ErrUnsupported
+}
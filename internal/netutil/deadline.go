@@ -0,0 +1,39 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// WatchContext bounds the I/O on conn by ctx until the returned stop is
+// called: conn takes ctx's deadline and pending reads and writes fail once
+// ctx is done. stop returns ctx's error when ctx ended first, otherwise it
+// clears the deadline for the caller to go on with conn.
+func WatchContext(ctx context.Context, conn net.Conn) (stop func() error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() error {
+		close(done)
+		<-stopped
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		conn.SetDeadline(time.Time{})
+		return nil
+	}
+}
@@ -1,3 +0,0 @@
-package proto
-
-// https://www.rfc-editor.org/info/rfc1961
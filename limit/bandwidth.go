@@ -0,0 +1,138 @@
+package limit
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+const (
+	// MaxChunk is the largest read charged at once, it keeps waits short on
+	// slow buckets
+	MaxChunk = 16 * 1024
+)
+
+// Bandwidth limits upload, client to destination, and download, destination
+// to client, in bytes per second. Zero is unlimited.
+type Bandwidth struct {
+	Upload   *Limiter
+	Download *Limiter
+}
+
+func NewBandwidth(upload, download int64) *Bandwidth {
+	return &Bandwidth{
+		Upload:   NewLimiter(upload),
+		Download: NewLimiter(download),
+	}
+}
+
+// Set changes both rates, relays in progress follow at once.
+func (self *Bandwidth) Set(upload, download int64) {
+	self.Upload.SetRate(upload)
+	self.Download.SetRate(download)
+}
+
+// UserBandwidth holds one Bandwidth per identity name, shared by all of the
+// identity's sessions. Names without their own rates get the default ones.
+type UserBandwidth struct {
+	lock      sync.Mutex
+	upload    int64
+	download  int64
+	users     map[string]*Bandwidth
+	overrides map[string]struct{}
+}
+
+func NewUserBandwidth(upload, download int64) *UserBandwidth {
+	return &UserBandwidth{
+		upload:    upload,
+		download:  download,
+		users:     make(map[string]*Bandwidth),
+		overrides: make(map[string]struct{}),
+	}
+}
+
+// Get returns the bandwidth shared by the sessions of name.
+func (self *UserBandwidth) Get(name string) *Bandwidth {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	bandwidth, ok := self.users[name]
+	if !ok {
+		bandwidth = NewBandwidth(self.upload, self.download)
+		self.users[name] = bandwidth
+	}
+
+	return bandwidth
+}
+
+// Set gives name its own rates.
+func (self *UserBandwidth) Set(name string, upload, download int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.overrides[name] = struct{}{}
+	if bandwidth, ok := self.users[name]; ok {
+		bandwidth.Set(upload, download)
+		return
+	}
+
+	self.users[name] = NewBandwidth(upload, download)
+}
+
+// SetDefault changes the rates of every name without its own.
+func (self *UserBandwidth) SetDefault(upload, download int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.upload, self.download = upload, download
+	for name, bandwidth := range self.users {
+		if _, ok := self.overrides[name]; !ok {
+			bandwidth.Set(upload, download)
+		}
+	}
+}
+
+// NewReader returns a reader charging what it reads to every limiter.
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+
+	return &reader{
+		Reader:   r,
+		ctx:      ctx,
+		limiters: limiters,
+	}
+}
+
+type reader struct {
+	io.Reader
+	ctx      context.Context
+	limiters []*Limiter
+}
+
+func (self *reader) Read(b []byte) (int, error) {
+	if len(b) > MaxChunk {
+		b = b[:MaxChunk]
+	}
+
+	n, err := self.Reader.Read(b)
+	if n > 0 {
+		if werr := WaitN(self.ctx, n, self.limiters...); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// WaitN takes n tokens from every limiter in turn.
+func WaitN(ctx context.Context, n int, limiters ...*Limiter) error {
+	for _, limiter := range limiters {
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// Package limit throttles the relay and bounds the number of sessions.
+package limit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at rate bytes per second, holding at
+// most one second worth of tokens. Waiters may drive the bucket negative, the
+// debt is paid by later waiters in arrival order so concurrent users of one
+// bucket get an even share. A zero rate is unlimited.
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate, waiters already sleeping keep their wait.
+func (self *Limiter) SetRate(rate int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	self.refill(now)
+	self.last = now
+
+	prev := self.rate
+	self.rate = float64(rate)
+	if rate <= 0 {
+		self.rate = 0
+	}
+
+	// a new bucket starts full
+	if prev == 0 || self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+}
+
+// Rate returns the rate in bytes per second, zero when unlimited.
+func (self *Limiter) Rate() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return int64(self.rate)
+}
+
+// WaitN takes n tokens, sleeping until the bucket has paid for them or ctx
+// is done.
+func (self *Limiter) WaitN(ctx context.Context, n int) error {
+	if self == nil {
+		return nil
+	}
+
+	self.lock.Lock()
+	if self.rate == 0 {
+		self.lock.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	self.refill(now)
+	self.last = now
+	self.tokens -= float64(n)
+
+	var wait time.Duration
+	if self.tokens < 0 {
+		wait = time.Duration(-self.tokens / self.rate * float64(time.Second))
+	}
+	self.lock.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (self *Limiter) refill(now time.Time) {
+	if self.rate == 0 || self.last.IsZero() {
+		return
+	}
+
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+}
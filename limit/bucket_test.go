@@ -0,0 +1,113 @@
+package limit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterWaitN(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter *Limiter
+		// taken in turn, the wait is for the last one
+		n        []int
+		min, max time.Duration
+	}{
+		{"nil", nil, []int{1 << 20}, 0, 50 * time.Millisecond},
+		{"unlimited", NewLimiter(0), []int{1 << 20, 1 << 20}, 0, 50 * time.Millisecond},
+		{"full bucket", NewLimiter(64 * 1024), []int{64 * 1024}, 0, 50 * time.Millisecond},
+		{"empty bucket", NewLimiter(64 * 1024), []int{64 * 1024, 16 * 1024}, 200 * time.Millisecond, 400 * time.Millisecond},
+		{"over the bucket", NewLimiter(64 * 1024), []int{96 * 1024}, 400 * time.Millisecond, 650 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last := len(tt.n) - 1
+			for _, n := range tt.n[:last] {
+				go tt.limiter.WaitN(context.Background(), n)
+			}
+			// the sleeping waiters above have taken their tokens
+			time.Sleep(10 * time.Millisecond)
+
+			start := time.Now()
+			if err := tt.limiter.WaitN(context.Background(), tt.n[last]); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+				t.Fatalf("waited %v, want %v to %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestLimiterWaitNCanceled(t *testing.T) {
+	limiter := NewLimiter(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := limiter.WaitN(ctx, 64*1024); err != context.DeadlineExceeded {
+		t.Fatalf("WaitN = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("canceled wait took %v", elapsed)
+	}
+}
+
+// TestLimiterSetRateWhileRunning changes the rate under sessions pulling
+// from one limiter and measures what they get in the next period.
+func TestLimiterSetRateWhileRunning(t *testing.T) {
+	const (
+		chunk  = 1024
+		period = 500 * time.Millisecond
+	)
+
+	tests := []struct {
+		name     string
+		from, to int64
+		// bytes taken in the period after the change
+		min, max int64
+	}{
+		{"lowered", 1 << 20, 8 * 1024, 2 * 1024, 16 * 1024},
+		{"raised", 8 * 1024, 1 << 20, 128 * 1024, 1 << 20},
+		{"unlimited", 8 * 1024, 0, 256 * 1024, -1},
+		{"limited", 0, 8 * 1024, 2 * 1024, 16 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewLimiter(tt.from)
+			ctx, cancel := context.WithCancel(context.Background())
+
+			var taken atomic.Int64
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for limiter.WaitN(ctx, chunk) == nil && ctx.Err() == nil {
+						taken.Add(chunk)
+					}
+				}()
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			limiter.SetRate(tt.to)
+			before := taken.Load()
+			time.Sleep(period)
+			got := taken.Load() - before
+			cancel()
+			wg.Wait()
+
+			if got < tt.min || (tt.max >= 0 && got > tt.max) {
+				t.Fatalf("%v bytes taken after the change, want %v to %v", got, tt.min, tt.max)
+			}
+			if limiter.Rate() != tt.to {
+				t.Fatalf("Rate = %v, want %v", limiter.Rate(), tt.to)
+			}
+		})
+	}
+}
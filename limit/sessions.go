@@ -0,0 +1,181 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ERR_TOO_MANY_SESSIONS = errors.New("too many sessions")
+)
+
+// SessionLimits bounds concurrent sessions, zero is unlimited.
+type SessionLimits struct {
+	Total   int
+	PerIP   int
+	PerUser int
+
+	// Queue is how many sessions may wait for each limit to free a slot,
+	// zero refuses them at once. Waiting gives up after QueueTimeout.
+	Queue        int
+	QueueTimeout time.Duration
+}
+
+// Sessions admits sessions within SessionLimits.
+type Sessions struct {
+	limits SessionLimits
+
+	lock  sync.Mutex
+	total *semaphore
+	ips   map[string]*semaphore
+	users map[string]*semaphore
+}
+
+func NewSessions(limits SessionLimits) *Sessions {
+	return &Sessions{
+		limits: limits,
+		total:  &semaphore{max: limits.Total},
+		ips:    make(map[string]*semaphore),
+		users:  make(map[string]*semaphore),
+	}
+}
+
+// Admit takes a slot for a session from ip, counting it in the total and in
+// the ip's sessions. The returned function frees the slot.
+func (self *Sessions) Admit(ctx context.Context, ip string) (func(), error) {
+	releaseIP, err := self.acquireKey(ctx, self.ips, ip, self.limits.PerIP)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := self.acquire(ctx, self.total); err != nil {
+		releaseIP()
+		return nil, err
+	}
+
+	return sync.OnceFunc(func() {
+		self.release(self.total)
+		releaseIP()
+	}), nil
+}
+
+// AdmitUser takes a slot among the sessions of the identity name.
+func (self *Sessions) AdmitUser(ctx context.Context, name string) (func(), error) {
+	release, err := self.acquireKey(ctx, self.users, name, self.limits.PerUser)
+	if err != nil {
+		return nil, err
+	}
+
+	return sync.OnceFunc(release), nil
+}
+
+// semaphore counts the sessions holding slots of one limit, queue holds the
+// waiters in arrival order.
+type semaphore struct {
+	max    int
+	active int
+	queue  []chan struct{}
+}
+
+func (self *Sessions) acquireKey(ctx context.Context, sems map[string]*semaphore, key string, max int) (func(), error) {
+	if max == 0 {
+		return func() {}, nil
+	}
+
+	self.lock.Lock()
+	sem, ok := sems[key]
+	if !ok {
+		sem = &semaphore{max: max}
+		sems[key] = sem
+	}
+
+	if err := self.acquireLocked(ctx, sem); err != nil {
+		self.forget(sems, key, sem)
+		return nil, err
+	}
+
+	return func() {
+		self.release(sem)
+		self.forget(sems, key, sem)
+	}, nil
+}
+
+func (self *Sessions) acquire(ctx context.Context, sem *semaphore) error {
+	self.lock.Lock()
+	return self.acquireLocked(ctx, sem)
+}
+
+// acquireLocked is called with the lock held and releases it.
+func (self *Sessions) acquireLocked(ctx context.Context, sem *semaphore) error {
+	if sem.max == 0 || sem.active < sem.max {
+		sem.active++
+		self.lock.Unlock()
+		return nil
+	}
+
+	if len(sem.queue) >= self.limits.Queue {
+		self.lock.Unlock()
+		return ERR_TOO_MANY_SESSIONS
+	}
+
+	ready := make(chan struct{})
+	sem.queue = append(sem.queue, ready)
+	self.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if self.limits.QueueTimeout > 0 {
+		timer := time.NewTimer(self.limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i, ch := range sem.queue {
+		if ch == ready {
+			sem.queue = append(sem.queue[:i], sem.queue[i+1:]...)
+			return ERR_TOO_MANY_SESSIONS
+		}
+	}
+
+	// the slot was handed over while giving up, pass it on
+	self.releaseLocked(sem)
+	return ERR_TOO_MANY_SESSIONS
+}
+
+func (self *Sessions) release(sem *semaphore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.releaseLocked(sem)
+}
+
+// releaseLocked hands the slot to the first waiter, the active count stays.
+func (self *Sessions) releaseLocked(sem *semaphore) {
+	if len(sem.queue) > 0 {
+		close(sem.queue[0])
+		sem.queue = sem.queue[1:]
+		return
+	}
+
+	sem.active--
+}
+
+func (self *Sessions) forget(sems map[string]*semaphore, key string, sem *semaphore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if sem.active == 0 && len(sem.queue) == 0 && sems[key] == sem {
+		delete(sems, key)
+	}
+}
@@ -0,0 +1,190 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// admitter takes a slot the way the server does for one kind of limit.
+type admitter func(sessions *Sessions, ctx context.Context, key string) (func(), error)
+
+func admitIP(sessions *Sessions, ctx context.Context, key string) (func(), error) {
+	return sessions.Admit(ctx, key)
+}
+
+func admitUser(sessions *Sessions, ctx context.Context, key string) (func(), error) {
+	return sessions.AdmitUser(ctx, key)
+}
+
+func TestSessionsOverLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits SessionLimits
+		admit  admitter
+		// keys of the sessions admitted in turn, the last one is refused
+		keys []string
+	}{
+		{"total", SessionLimits{Total: 2}, admitIP, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"per ip", SessionLimits{PerIP: 1}, admitIP, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"}},
+		{"per user", SessionLimits{PerUser: 2}, admitUser, []string{"alice", "bob", "alice", "alice"}},
+		{"ip counts in total", SessionLimits{Total: 2, PerIP: 2}, admitIP, []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := NewSessions(tt.limits)
+			last := len(tt.keys) - 1
+
+			var releases []func()
+			for _, key := range tt.keys[:last] {
+				release, err := tt.admit(sessions, context.Background(), key)
+				if err != nil {
+					t.Fatalf("admit %v: %v", key, err)
+				}
+				releases = append(releases, release)
+			}
+
+			start := time.Now()
+			if _, err := tt.admit(sessions, context.Background(), tt.keys[last]); err != ERR_TOO_MANY_SESSIONS {
+				t.Fatalf("admit %v = %v, want ERR_TOO_MANY_SESSIONS", tt.keys[last], err)
+			}
+			if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+				t.Fatalf("refusal without a queue took %v", elapsed)
+			}
+
+			// a freed slot is free for the refused key, released twice or not
+			releases[0]()
+			releases[0]()
+			release, err := tt.admit(sessions, context.Background(), tt.keys[last])
+			if err != nil {
+				t.Fatalf("admit %v after a release: %v", tt.keys[last], err)
+			}
+			release()
+
+			for _, release := range releases[1:] {
+				release()
+			}
+			if len(sessions.ips) != 0 || len(sessions.users) != 0 || sessions.total.active != 0 {
+				t.Fatalf("%v ips, %v users, %v active left", len(sessions.ips), len(sessions.users), sessions.total.active)
+			}
+		})
+	}
+}
+
+func TestSessionsQueue(t *testing.T) {
+	tests := []struct {
+		name string
+		// the holder frees its slot after release, never when zero
+		release time.Duration
+		timeout time.Duration
+		err     error
+	}{
+		{"handed over", 50 * time.Millisecond, time.Second, nil},
+		{"timed out", 0, 100 * time.Millisecond, ERR_TOO_MANY_SESSIONS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := NewSessions(SessionLimits{PerIP: 1, Queue: 1, QueueTimeout: tt.timeout})
+			holder, err := sessions.Admit(context.Background(), "10.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.release > 0 {
+				time.AfterFunc(tt.release, holder)
+			}
+
+			waited := make(chan error, 1)
+			go func() {
+				release, err := sessions.Admit(context.Background(), "10.0.0.1")
+				if err == nil {
+					release()
+				}
+				waited <- err
+			}()
+
+			// the queue holds one
+			time.Sleep(20 * time.Millisecond)
+			if _, err := sessions.Admit(context.Background(), "10.0.0.1"); err != ERR_TOO_MANY_SESSIONS {
+				t.Fatalf("admit past a full queue = %v, want ERR_TOO_MANY_SESSIONS", err)
+			}
+
+			start := time.Now()
+			if err := <-waited; err != tt.err {
+				t.Fatalf("queued admit = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil && time.Since(start) < tt.timeout/2 {
+				t.Fatalf("queued admit gave up after %v, before the timeout", time.Since(start))
+			}
+
+			if tt.release == 0 {
+				holder()
+			}
+			if len(sessions.ips) != 0 {
+				t.Fatalf("%v ips left", len(sessions.ips))
+			}
+		})
+	}
+}
+
+// TestSessionsHandOffWhileGivingUp hands the slot to a waiter that has just
+// given up, the waiter has to pass it on to the next one.
+func TestSessionsHandOffWhileGivingUp(t *testing.T) {
+	sessions := NewSessions(SessionLimits{Total: 1, Queue: 2})
+	if err := sessions.acquire(context.Background(), sessions.total); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		first <- sessions.acquire(ctx, sessions.total)
+	}()
+	waitQueued(t, sessions, 1)
+
+	second := make(chan error, 1)
+	go func() {
+		second <- sessions.acquire(context.Background(), sessions.total)
+	}()
+	waitQueued(t, sessions, 2)
+
+	// the first waiter gives up and blocks on the lock, meanwhile the holder
+	// hands it the slot
+	sessions.lock.Lock()
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	sessions.releaseLocked(sessions.total)
+	sessions.lock.Unlock()
+
+	if err := <-first; err != ERR_TOO_MANY_SESSIONS {
+		t.Fatalf("first waiter = %v, want ERR_TOO_MANY_SESSIONS", err)
+	}
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Fatalf("second waiter = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slot was not passed on")
+	}
+
+	sessions.release(sessions.total)
+	if sessions.total.active != 0 || len(sessions.total.queue) != 0 {
+		t.Fatalf("%v active, %v queued left", sessions.total.active, len(sessions.total.queue))
+	}
+}
+
+func waitQueued(t *testing.T, sessions *Sessions, n int) {
+	for i := 0; i < 100; i++ {
+		sessions.lock.Lock()
+		queued := len(sessions.total.queue)
+		sessions.lock.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("%v waiters never queued", n)
+}
@@ -0,0 +1,16 @@
+package outbound
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer opens the outbound connection for a CONNECT request.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewDirectDialer returns a Dialer connecting straight to the destination.
+func NewDirectDialer() Dialer {
+	return &net.Dialer{}
+}
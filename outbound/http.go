@@ -0,0 +1,125 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/lkyzhu/socks5/internal/netutil"
+	"github.com/lkyzhu/socks5/proto"
+)
+
+// HTTPError is returned when the HTTP proxy refuses a CONNECT request.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (self *HTTPError) Error() string {
+	return "http connect: " + self.Status
+}
+
+// ReplyCode maps the proxy's status to the SOCKS reply sent to the client.
+func (self *HTTPError) ReplyCode() byte {
+	switch self.StatusCode {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return byte(proto.RuleFailure)
+	case http.StatusNotFound, http.StatusBadGateway:
+		return byte(proto.HostUnreachable)
+	case http.StatusServiceUnavailable:
+		return byte(proto.NetworkUnreachable)
+	case http.StatusGatewayTimeout:
+		return byte(proto.TTLExpired)
+	}
+
+	return byte(proto.ServerFailure)
+}
+
+// NewHTTPConnectDialer returns a Dialer tunneling through the HTTP proxy at
+// addr with the CONNECT method. Credentials are sent with Basic
+// Proxy-Authorization when user is not empty. A nil forward dials the proxy
+// directly.
+func NewHTTPConnectDialer(addr string, user, password string, forward Dialer) Dialer {
+	if forward == nil {
+		forward = NewDirectDialer()
+	}
+
+	return &httpConnectDialer{
+		addr:     addr,
+		user:     user,
+		password: password,
+		forward:  forward,
+	}
+}
+
+type httpConnectDialer struct {
+	addr     string
+	user     string
+	password string
+	forward  Dialer
+}
+
+func (self *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http connect: unsupported network %v", network)
+	}
+
+	conn, err := self.forward.DialContext(ctx, "tcp", self.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := netutil.WatchContext(ctx, conn)
+	result, err := self.connect(conn, addr)
+	if stopErr := stop(); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (self *httpConnectDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if self.user != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(self.user + ":" + self.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	// the tunnel may already carry bytes from the destination
+	if reader.Buffered() > 0 {
+		return netutil.NewBufferedConn(conn, reader), nil
+	}
+
+	return conn, nil
+}
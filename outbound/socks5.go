@@ -0,0 +1,18 @@
+package outbound
+
+import (
+	"github.com/lkyzhu/socks5/client"
+)
+
+// NewSOCKS5Dialer returns a Dialer tunneling through the SOCKS5 proxy at
+// addr, which is itself reached through forward. A nil forward dials the proxy
+// directly, a nil auth offers only the no-authentication method.
+//
+// Reply codes sent by the proxy are returned as *client.ReplyError.
+func NewSOCKS5Dialer(addr string, auth *client.Auth, forward Dialer) Dialer {
+	if forward == nil {
+		forward = NewDirectDialer()
+	}
+
+	return client.NewDialer("tcp", addr, auth, client.WithForward(forward))
+}
@@ -0,0 +1,176 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// https://www.rfc-editor.org/info/rfc1961
+
+const (
+	GSSAPI_VERSION byte = 0x01
+
+	MaxGSSAPIToken = 0xFFFF
+)
+
+const (
+	GSSAPIAuthentication = byte(0x01)
+	GSSAPIProtection     = byte(0x02)
+	GSSAPIEncapsulation  = byte(0x03)
+	GSSAPIAbort          = byte(0xFF)
+)
+
+// protection levels negotiated with GSSAPIProtection
+const (
+	GSSAPIIntegrity       = byte(0x01)
+	GSSAPIConfidentiality = byte(0x02)
+	GSSAPISelective       = byte(0x03)
+)
+
+var (
+	ERR_GSSAPI_ABORT     = errors.New("gssapi context aborted")
+	ERR_GSSAPI_MSG_TYPE  = errors.New("unexpected gssapi message type")
+	ERR_GSSAPI_TOO_LARGE = errors.New("gssapi token too large")
+)
+
+// GSSAPI message:
+// +------+------+------+.......................+
+// + ver  | mtyp | len  |       token           |
+// +------+------+------+.......................+
+// + 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+// +------+------+------+.......................+
+//
+// An abort message is only VER and MTYP X'FF'.
+type GSSAPIMessage struct {
+	Ver   byte
+	MTyp  byte
+	Token []byte
+
+	hdr [4]byte
+}
+
+func (self *GSSAPIMessage) AppendBinary(b []byte) ([]byte, error) {
+	if self.MTyp == GSSAPIAbort {
+		return append(b, self.Ver, self.MTyp), nil
+	}
+
+	if len(self.Token) > MaxGSSAPIToken {
+		return b, ERR_GSSAPI_TOO_LARGE
+	}
+
+	b = append(b, self.Ver, self.MTyp)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(self.Token)))
+	return append(b, self.Token...), nil
+}
+
+// Decode parses one message, Token aliases b.
+func (self *GSSAPIMessage) Decode(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	if err := self.header(b); err != nil {
+		return 0, err
+	}
+
+	if len(b) < 4 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	n := 4 + int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) < n {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Token = b[4:n]
+	return n, nil
+}
+
+func (self *GSSAPIMessage) header(b []byte) error {
+	self.Ver = b[0]
+	self.MTyp = b[1]
+
+	if self.Ver != GSSAPI_VERSION {
+		return ERR_INVALID_VERSION
+	}
+
+	if self.MTyp == GSSAPIAbort {
+		return ERR_GSSAPI_ABORT
+	}
+
+	return nil
+}
+
+// Read reads one message, the token reuses the previous token's storage when
+// it is large enough.
+func (self *GSSAPIMessage) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.hdr[:2]); err != nil {
+		return err
+	}
+
+	if err := self.header(self.hdr[:2]); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, self.hdr[2:]); err != nil {
+		return err
+	}
+
+	n := int(binary.BigEndian.Uint16(self.hdr[2:]))
+	if cap(self.Token) < n {
+		self.Token = make([]byte, n)
+	}
+	self.Token = self.Token[:n]
+	if _, err := io.ReadFull(r, self.Token); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Write sends the header and the token in two writes rather than copying the
+// token.
+func (self *GSSAPIMessage) Write(w io.Writer) error {
+	if self.MTyp == GSSAPIAbort {
+		b, _ := self.AppendBinary(self.hdr[:0])
+		_, err := w.Write(b)
+		return err
+	}
+
+	if len(self.Token) > MaxGSSAPIToken {
+		return ERR_GSSAPI_TOO_LARGE
+	}
+
+	self.hdr[0] = self.Ver
+	self.hdr[1] = self.MTyp
+	binary.BigEndian.PutUint16(self.hdr[2:], uint16(len(self.Token)))
+	if _, err := w.Write(self.hdr[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(self.Token)
+	return err
+}
+
+// ReadGSSAPIMessage reads the next message and checks it has type mtyp.
+func ReadGSSAPIMessage(r io.Reader, mtyp byte) (*GSSAPIMessage, error) {
+	msg := &GSSAPIMessage{}
+	if err := msg.Read(r); err != nil {
+		return nil, err
+	}
+
+	if msg.MTyp != mtyp {
+		return nil, ERR_GSSAPI_MSG_TYPE
+	}
+
+	return msg, nil
+}
+
+func WriteGSSAPIMessage(w io.Writer, msg *GSSAPIMessage) error {
+	if msg == nil {
+		return errors.New("msg is invalid")
+	}
+
+	return msg.Write(w)
+}
@@ -0,0 +1,205 @@
+package proto
+
+import (
+	"errors"
+	"io"
+)
+
+// https://www.rfc-editor.org/rfc/rfc1929
+
+const (
+	USERPASS_VERSION byte = 0x01
+)
+
+// Username/Password request:
+// +----+------+----------+------+----------+
+// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+// +----+------+----------+------+----------+
+// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+// +----+------+----------+------+----------+
+
+type UserPasswordRequest struct {
+	Ver    byte
+	Ulen   byte
+	Uname  []byte
+	Plen   byte
+	Passwd []byte
+
+	buf [1 + 1 + 255 + 1 + 255]byte
+}
+
+func (self *UserPasswordRequest) AppendBinary(b []byte) ([]byte, error) {
+	if len(self.Uname) == 0 || len(self.Uname) > 255 || len(self.Passwd) == 0 || len(self.Passwd) > 255 {
+		return b, ERR_INVALID_LENGTH
+	}
+
+	b = append(b, self.Ver, byte(len(self.Uname)))
+	b = append(b, self.Uname...)
+	b = append(b, byte(len(self.Passwd)))
+	return append(b, self.Passwd...), nil
+}
+
+func (self *UserPasswordRequest) Decode(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Ver = b[0]
+	self.Ulen = b[1]
+	if self.Ver != USERPASS_VERSION {
+		return 0, ERR_INVALID_VERSION
+	}
+	if self.Ulen == 0 {
+		return 0, ERR_INVALID_LENGTH
+	}
+
+	plenAt := 2 + int(self.Ulen)
+	if len(b) < plenAt+1 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Plen = b[plenAt]
+	if self.Plen == 0 {
+		return 0, ERR_INVALID_LENGTH
+	}
+
+	n := plenAt + 1 + int(self.Plen)
+	if len(b) < n {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	copy(self.buf[:], b[:n])
+	self.Uname = self.buf[2:plenAt]
+	self.Passwd = self.buf[plenAt+1 : n]
+	return n, nil
+}
+
+func (self *UserPasswordRequest) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:2]); err != nil {
+		return err
+	}
+	self.Ver = self.buf[0]
+	self.Ulen = self.buf[1]
+
+	if self.Ver != USERPASS_VERSION {
+		return ERR_INVALID_VERSION
+	}
+	if self.Ulen == 0 {
+		return ERR_INVALID_LENGTH
+	}
+
+	// UNAME and PLEN
+	plenAt := 2 + int(self.Ulen)
+	if _, err := io.ReadFull(r, self.buf[2:plenAt+1]); err != nil {
+		return err
+	}
+	self.Uname = self.buf[2:plenAt]
+
+	self.Plen = self.buf[plenAt]
+	if self.Plen == 0 {
+		return ERR_INVALID_LENGTH
+	}
+
+	self.Passwd = self.buf[plenAt+1 : plenAt+1+int(self.Plen)]
+	if _, err := io.ReadFull(r, self.Passwd); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (self *UserPasswordRequest) Write(w io.Writer) error {
+	// fields decoded by Read sit at the offsets they are encoded to
+	b, err := self.AppendBinary(self.buf[:0])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func ReadUserPasswordRequest(r io.Reader) (*UserPasswordRequest, error) {
+	req := &UserPasswordRequest{}
+	if err := req.Read(r); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func WriteUserPasswordRequest(w io.Writer, req *UserPasswordRequest) error {
+	if req == nil {
+		return errors.New("invalid request")
+	}
+
+	return req.Write(w)
+}
+
+// Username/Password reply:
+// +----+--------+
+// |VER | STATUS |
+// +----+--------+
+// | 1  |   1    |
+// +----+--------+
+type AuthReply struct {
+	Ver    byte
+	Status byte
+
+	buf [2]byte
+}
+
+const (
+	AuthSuccess = byte(0x00)
+	AuthFailure = byte(0x01)
+)
+
+func (self *AuthReply) AppendBinary(b []byte) ([]byte, error) {
+	return append(b, self.Ver, self.Status), nil
+}
+
+func (self *AuthReply) Decode(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Ver = b[0]
+	self.Status = b[1]
+	if self.Ver != USERPASS_VERSION {
+		return 0, ERR_INVALID_VERSION
+	}
+
+	return 2, nil
+}
+
+func (self *AuthReply) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:]); err != nil {
+		return err
+	}
+
+	_, err := self.Decode(self.buf[:])
+	return err
+}
+
+func (self *AuthReply) Write(w io.Writer) error {
+	b, _ := self.AppendBinary(self.buf[:0])
+	_, err := w.Write(b)
+	return err
+}
+
+func ReadAuthReply(r io.Reader) (*AuthReply, error) {
+	rep := &AuthReply{}
+	if err := rep.Read(r); err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
+
+func WriteAuthReply(w io.Writer, rep *AuthReply) error {
+	if rep == nil {
+		return errors.New("invalid reply")
+	}
+
+	return rep.Write(w)
+}
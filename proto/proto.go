@@ -0,0 +1,648 @@
+// Package proto encodes and decodes the SOCKS wire messages.
+//
+// Every message offers an append-style AppendBinary encoder, a Decode method
+// parsing a byte slice and Read/Write methods working over io.Reader and
+// io.Writer. Read consumes exactly one message with full-length reads, so a
+// single buffered reader can be shared by all stages of a session without
+// losing bytes the client pipelined behind the message.
+//
+// Messages keep their variable fields in storage owned by the message, a
+// message value reused for decoding does not allocate. Slices such as
+// Methods or Addr.IP are only valid until the message is decoded again;
+// domain names are the exception, they are strings and decoding a name that
+// differs from the previous one copies it.
+package proto
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	VERSION byte = 0x5
+)
+
+var (
+	ERR_INVALID_VERSION  = errors.New("unsupported version")
+	ERR_INVALID_ADDR     = errors.New("invalid addr")
+	ERR_INVALID_RESERVED = errors.New("reserved field is not zero")
+	ERR_INVALID_LENGTH   = errors.New("invalid field length")
+	ERR_SHORT_BUFFER     = errors.New("short buffer")
+)
+
+const (
+	ATYP_IPV4   = 0x01
+	ATYP_DOMAIN = 0x03
+	ATYP_IPV6   = 0x04
+
+	// ATYP, the longest DST.ADDR and DST.PORT
+	maxAddrLen = 1 + 1 + 255 + 2
+)
+
+// https://datatracker.ietf.org/doc/html/rfc1928
+
+// version identifier/method selection message:
+// +----+----------+----------+
+// |VER | NMETHODS | METHODS  |
+// +----+----------+----------+
+// | 1  |    1     | 1 to 255 |
+// +----+----------+----------+
+type MethodRequest struct {
+	Ver      byte
+	NMethods byte
+	Methods  []byte
+
+	buf [2 + 255]byte
+}
+
+func (self *MethodRequest) AppendBinary(b []byte) ([]byte, error) {
+	if len(self.Methods) == 0 || len(self.Methods) > 255 {
+		return b, ERR_INVALID_LENGTH
+	}
+
+	b = append(b, self.Ver, byte(len(self.Methods)))
+	return append(b, self.Methods...), nil
+}
+
+func (self *MethodRequest) Decode(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	if err := self.header(b); err != nil {
+		return 0, err
+	}
+
+	n := 2 + int(self.NMethods)
+	if len(b) < n {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Methods = self.buf[2:n]
+	copy(self.Methods, b[2:n])
+	return n, nil
+}
+
+func (self *MethodRequest) header(b []byte) error {
+	self.Ver = b[0]
+	self.NMethods = b[1]
+
+	if self.Ver != VERSION {
+		return ERR_INVALID_VERSION
+	}
+
+	if self.NMethods == 0 {
+		return ERR_INVALID_LENGTH
+	}
+
+	return nil
+}
+
+func (self *MethodRequest) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:2]); err != nil {
+		return err
+	}
+
+	if err := self.header(self.buf[:2]); err != nil {
+		return err
+	}
+
+	self.Methods = self.buf[2 : 2+int(self.NMethods)]
+	if _, err := io.ReadFull(r, self.Methods); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (self *MethodRequest) Write(w io.Writer) error {
+	b, err := self.AppendBinary(self.buf[:0])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func ReadMethodRequest(r io.Reader) (*MethodRequest, error) {
+	req := &MethodRequest{}
+	if err := req.Read(r); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func WriteMethodRequest(w io.Writer, req *MethodRequest) error {
+	if req == nil {
+		return errors.New("req is invalid")
+	}
+	return req.Write(w)
+}
+
+// METHOD selection message:
+// +----+--------+
+// |VER | METHOD |
+// +----+--------+
+// | 1  |   1    |
+// +----+--------+
+type MethodReply struct {
+	Ver    byte
+	Method byte
+
+	buf [2]byte
+}
+
+func (self *MethodReply) AppendBinary(b []byte) ([]byte, error) {
+	return append(b, self.Ver, self.Method), nil
+}
+
+func (self *MethodReply) Decode(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Ver = b[0]
+	self.Method = b[1]
+	if self.Ver != VERSION {
+		return 0, ERR_INVALID_VERSION
+	}
+
+	return 2, nil
+}
+
+func (self *MethodReply) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:]); err != nil {
+		return err
+	}
+
+	_, err := self.Decode(self.buf[:])
+	return err
+}
+
+func (self *MethodReply) Write(w io.Writer) error {
+	b, _ := self.AppendBinary(self.buf[:0])
+	_, err := w.Write(b)
+	return err
+}
+
+func ReadMethodReply(r io.Reader) (*MethodReply, error) {
+	rep := &MethodReply{}
+	if err := rep.Read(r); err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
+
+func WriteMethodReply(w io.Writer, rep *MethodReply) error {
+	if rep == nil {
+		return errors.New("rep is invalid")
+	}
+
+	return rep.Write(w)
+}
+
+type Addr struct {
+	Type   byte
+	Port   uint16
+	IP     net.IP
+	Domain string
+
+	ip [net.IPv6len]byte
+}
+
+func NewAddr(ip net.IP, port int) Addr {
+	addr := Addr{
+		Type: ATYP_IPV4,
+		IP:   ip,
+		Port: uint16(port),
+	}
+
+	if ip != nil && ip.To4() == nil {
+		addr.Type = ATYP_IPV6
+	}
+
+	return addr
+}
+
+// Len returns the encoded length of ATYP, DST.ADDR and DST.PORT.
+func (self *Addr) Len() int {
+	switch self.Type {
+	case ATYP_IPV4:
+		return 1 + net.IPv4len + 2
+	case ATYP_IPV6:
+		return 1 + net.IPv6len + 2
+	case ATYP_DOMAIN:
+		return 1 + 1 + len(self.Domain) + 2
+	}
+
+	return 0
+}
+
+func (self *Addr) AppendBinary(b []byte) ([]byte, error) {
+	switch self.Type {
+	case ATYP_IPV4:
+		ip := self.IP.To4()
+		if ip == nil {
+			if self.IP != nil {
+				return b, ERR_INVALID_ADDR
+			}
+			ip = net.IPv4zero.To4()
+		}
+		b = append(b, self.Type)
+		b = append(b, ip...)
+
+	case ATYP_IPV6:
+		ip := self.IP.To16()
+		if ip == nil {
+			return b, ERR_INVALID_ADDR
+		}
+		b = append(b, self.Type)
+		b = append(b, ip...)
+
+	case ATYP_DOMAIN:
+		if len(self.Domain) == 0 || len(self.Domain) > 255 {
+			return b, ERR_INVALID_ADDR
+		}
+		b = append(b, self.Type, byte(len(self.Domain)))
+		b = append(b, self.Domain...)
+
+	default:
+		return b, ERR_INVALID_ADDR
+	}
+
+	return binary.BigEndian.AppendUint16(b, self.Port), nil
+}
+
+func (self *Addr) Decode(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	n, err := addrLen(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(b) < n {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Type = b[0]
+	switch self.Type {
+	case ATYP_IPV4, ATYP_IPV6:
+		self.IP = self.ip[:n-3]
+		copy(self.IP, b[1:])
+		self.Domain = ""
+
+	case ATYP_DOMAIN:
+		self.IP = nil
+		setString(&self.Domain, b[2:n-2])
+	}
+
+	self.Port = binary.BigEndian.Uint16(b[n-2:])
+	return n, nil
+}
+
+// addrLen returns the encoded length of the address starting b, b holds at
+// least ATYP and, for domains, the length octet.
+func addrLen(b []byte) (int, error) {
+	switch b[0] {
+	case ATYP_IPV4:
+		return 1 + net.IPv4len + 2, nil
+	case ATYP_IPV6:
+		return 1 + net.IPv6len + 2, nil
+	case ATYP_DOMAIN:
+		if len(b) < 2 {
+			return 0, ERR_SHORT_BUFFER
+		}
+		if b[1] == 0 {
+			return 0, ERR_INVALID_ADDR
+		}
+		return 1 + 1 + int(b[1]) + 2, nil
+	}
+
+	return 0, ERR_INVALID_ADDR
+}
+
+// readAddr reads one address into buf, which holds at least maxAddrLen bytes,
+// and returns its encoded length.
+func readAddr(r io.Reader, buf []byte) (int, error) {
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return 0, err
+	}
+
+	read := 1
+	if buf[0] == ATYP_DOMAIN {
+		if _, err := io.ReadFull(r, buf[1:2]); err != nil {
+			return 0, err
+		}
+		read = 2
+	}
+
+	n, err := addrLen(buf[:read])
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := io.ReadFull(r, buf[read:n]); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// The SOCKS request is formed as follows:
+// +----+-----+-------+------+----------+----------+
+// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+type CommandRequest struct {
+	Ver  byte
+	Cmd  byte
+	Rsv  byte
+	Dest Addr
+
+	buf [3 + maxAddrLen]byte
+}
+
+func (self *CommandRequest) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, self.Ver, self.Cmd, self.Rsv)
+	return self.Dest.AppendBinary(b)
+}
+
+func (self *CommandRequest) Decode(b []byte) (int, error) {
+	if len(b) < 3 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	if err := self.header(b); err != nil {
+		return 0, err
+	}
+
+	n, err := self.Dest.Decode(b[3:])
+	if err != nil {
+		return 0, err
+	}
+
+	return 3 + n, nil
+}
+
+func (self *CommandRequest) header(b []byte) error {
+	self.Ver = b[0]
+	self.Cmd = b[1]
+	self.Rsv = b[2]
+
+	if self.Ver != VERSION {
+		return ERR_INVALID_VERSION
+	}
+
+	if self.Rsv != 0 {
+		return ERR_INVALID_RESERVED
+	}
+
+	return nil
+}
+
+func (self *CommandRequest) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:3]); err != nil {
+		return err
+	}
+
+	if err := self.header(self.buf[:3]); err != nil {
+		return err
+	}
+
+	n, err := readAddr(r, self.buf[3:])
+	if err != nil {
+		return err
+	}
+
+	_, err = self.Dest.Decode(self.buf[3 : 3+n])
+	return err
+}
+
+func (self *CommandRequest) Write(w io.Writer) error {
+	b, err := self.AppendBinary(self.buf[:0])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func ReadCommandRequest(r io.Reader) (*CommandRequest, error) {
+	req := &CommandRequest{}
+	if err := req.Read(r); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func WriteCommandRequest(w io.Writer, req *CommandRequest) error {
+	if req == nil {
+		return errors.New("req is invalid")
+	}
+
+	return req.Write(w)
+}
+
+// The SOCKS reply formed as follows:
+// +----+-----+-------+------+----------+----------+
+// |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+type CommandReply struct {
+	Ver byte
+	Rep byte
+	Rsv byte
+	Bnd Addr
+
+	buf [3 + maxAddrLen]byte
+}
+
+func (self *CommandReply) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, self.Ver, self.Rep, self.Rsv)
+	return self.Bnd.AppendBinary(b)
+}
+
+func (self *CommandReply) Decode(b []byte) (int, error) {
+	if len(b) < 3 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	if err := self.header(b); err != nil {
+		return 0, err
+	}
+
+	n, err := self.Bnd.Decode(b[3:])
+	if err != nil {
+		return 0, err
+	}
+
+	return 3 + n, nil
+}
+
+func (self *CommandReply) header(b []byte) error {
+	self.Ver = b[0]
+	self.Rep = b[1]
+	self.Rsv = b[2]
+
+	if self.Ver != VERSION {
+		return ERR_INVALID_VERSION
+	}
+
+	if self.Rsv != 0 {
+		return ERR_INVALID_RESERVED
+	}
+
+	return nil
+}
+
+func (self *CommandReply) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:3]); err != nil {
+		return err
+	}
+
+	if err := self.header(self.buf[:3]); err != nil {
+		return err
+	}
+
+	n, err := readAddr(r, self.buf[3:])
+	if err != nil {
+		return err
+	}
+
+	_, err = self.Bnd.Decode(self.buf[3 : 3+n])
+	return err
+}
+
+func (self *CommandReply) Write(w io.Writer) error {
+	b, err := self.AppendBinary(self.buf[:0])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func ReadCommandReply(r io.Reader) (*CommandReply, error) {
+	rep := &CommandReply{}
+	if err := rep.Read(r); err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
+
+func WriteCommandReply(w io.Writer, rep *CommandReply) error {
+	if rep == nil {
+		return errors.New("rep is invalid")
+	}
+
+	return rep.Write(w)
+}
+
+type ReplyCode byte
+
+const (
+	Success ReplyCode = iota
+	ServerFailure
+	RuleFailure
+	NetworkUnreachable
+	HostUnreachable
+	ConnectionRefused
+	TTLExpired
+	CommandNotSupport
+	AddressTypeNotSupport
+
+	//  X'09' to X'FF' unassigned
+)
+
+func (self *ReplyCode) String() string {
+	switch *self {
+	case Success:
+		return "success"
+	case ServerFailure:
+		return "general SOCKS server failure"
+	case RuleFailure:
+		return "connection not allowed by ruleset"
+	case NetworkUnreachable:
+		return "Network unreachable"
+	case HostUnreachable:
+		return "Host unreachable"
+	case ConnectionRefused:
+		return "Connection refused"
+	case TTLExpired:
+		return "TTL expired"
+	case CommandNotSupport:
+		return "Command not supported"
+	case AddressTypeNotSupport:
+		return "Address type not supported"
+	}
+
+	return "unassigned code"
+}
+
+// ReplyCodeError is implemented by errors that carry their own reply code,
+// such as the failure replies of an upstream proxy.
+type ReplyCodeError interface {
+	error
+	ReplyCode() byte
+}
+
+// ReplyCodeFromError classifies err into the reply sent to the client,
+// errors that fit no other code are a general server failure.
+func ReplyCodeFromError(err error) ReplyCode {
+	if err == nil {
+		return Success
+	}
+
+	var coded ReplyCodeError
+	if errors.As(err, &coded) {
+		return ReplyCode(coded.ReplyCode())
+	}
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ERR_INVALID_ADDR):
+		return AddressTypeNotSupport
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return HostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return TTLExpired
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return TTLExpired
+		}
+		return HostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return TTLExpired
+	}
+
+	return ServerFailure
+}
+
+const (
+	CmdType byte = iota
+	Connect
+	Bind
+	Associate
+)
@@ -0,0 +1,264 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// BenchmarkCodec runs Decode, Read and AppendBinary of every message with a
+// reused value, the hot path of a server.
+func BenchmarkCodec(b *testing.B) {
+	for _, tt := range testMessages() {
+		encoded, err := tt.msg.AppendBinary(nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(tt.name+"/Decode", func(b *testing.B) {
+			msg := tt.decoded()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg.Decode(encoded)
+			}
+		})
+
+		b.Run(tt.name+"/Read", func(b *testing.B) {
+			msg := tt.decoded()
+			r := bytes.NewReader(encoded)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset(encoded)
+				msg.Read(r)
+			}
+		})
+
+		b.Run(tt.name+"/AppendBinary", func(b *testing.B) {
+			out := make([]byte, 0, 1024)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tt.msg.AppendBinary(out[:0])
+			}
+		})
+	}
+}
+
+// BenchmarkBaseline compares the messages of a session with the codec they
+// replaced, which allocated on every Read and Write.
+func BenchmarkBaseline(b *testing.B) {
+	method, _ := (&MethodRequest{Ver: VERSION, Methods: []byte{0x00, 0x02}}).AppendBinary(nil)
+	command, _ := (&CommandRequest{Ver: VERSION, Cmd: Connect, Dest: Addr{Type: ATYP_DOMAIN, Domain: "www.example.com", Port: 443}}).AppendBinary(nil)
+	r := bytes.NewReader(nil)
+
+	b.Run("MethodRequest/Read", func(b *testing.B) {
+		var req MethodRequest
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(method)
+			req.Read(r)
+		}
+	})
+	b.Run("MethodRequest/Read/baseline", func(b *testing.B) {
+		var req baselineMethodRequest
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(method)
+			req.Read(r)
+		}
+	})
+
+	b.Run("CommandRequest/Read", func(b *testing.B) {
+		var req CommandRequest
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(command)
+			req.Read(r)
+		}
+	})
+	b.Run("CommandRequest/Read/baseline", func(b *testing.B) {
+		var req baselineCommandRequest
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(command)
+			req.Read(r)
+		}
+	})
+
+	reply := &CommandReply{Ver: VERSION, Rep: byte(Success), Bnd: NewAddr(net.IPv4(192, 0, 2, 1), 1080)}
+	b.Run("CommandReply/Write", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reply.Write(io.Discard)
+		}
+	})
+	b.Run("CommandReply/Write/baseline", func(b *testing.B) {
+		rep := &baselineCommandReply{Ver: reply.Ver, Rep: reply.Rep, Bnd: baselineAddr{Type: reply.Bnd.Type, IP: reply.Bnd.IP, Port: reply.Bnd.Port}}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rep.Write(io.Discard)
+		}
+	})
+}
+
+// The codec before messages kept their own storage, kept to benchmark
+// against.
+
+type baselineMethodRequest struct {
+	Ver      byte
+	NMethods byte
+	Methods  []byte
+}
+
+func (self *baselineMethodRequest) Read(r io.Reader) error {
+	tmp := make([]byte, 2)
+	if _, err := io.ReadFull(r, tmp); err != nil {
+		return err
+	}
+	self.Ver = tmp[0]
+	self.NMethods = tmp[1]
+
+	if self.Ver != VERSION {
+		return ERR_INVALID_VERSION
+	}
+
+	self.Methods = make([]byte, self.NMethods)
+	if _, err := io.ReadFull(r, self.Methods); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type baselineAddr struct {
+	Type   byte
+	Port   uint16
+	IP     net.IP
+	Domain string
+}
+
+func (self *baselineAddr) Read(r io.Reader) error {
+	tmp := make([]byte, 1)
+	if _, err := io.ReadFull(r, tmp); err != nil {
+		return err
+	}
+	self.Type = tmp[0]
+
+	switch self.Type {
+	case ATYP_IPV4:
+		tmp := make([]byte, net.IPv4len+2)
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return err
+		}
+		self.IP = net.IPv4(tmp[0], tmp[1], tmp[2], tmp[3])
+		self.Port = binary.BigEndian.Uint16(tmp[net.IPv4len:])
+
+	case ATYP_IPV6:
+		tmp := make([]byte, net.IPv6len+2)
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return err
+		}
+		self.IP = tmp[:net.IPv6len]
+		self.Port = binary.BigEndian.Uint16(tmp[net.IPv6len:])
+
+	case ATYP_DOMAIN:
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return err
+		}
+		dlen := int(tmp[0])
+		tmp := make([]byte, dlen+2)
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return err
+		}
+		self.Domain = string(tmp[:dlen])
+		self.Port = binary.BigEndian.Uint16(tmp[dlen:])
+
+	default:
+		return ERR_INVALID_ADDR
+	}
+
+	return nil
+}
+
+func (self *baselineAddr) Write(buf *bufio.Writer) error {
+	if err := buf.WriteByte(self.Type); err != nil {
+		return err
+	}
+
+	switch self.Type {
+	case ATYP_IPV4:
+		tmp := make([]byte, net.IPv4len+2)
+		copy(tmp, self.IP.To4())
+		binary.BigEndian.PutUint16(tmp[net.IPv4len:], self.Port)
+		_, err := buf.Write(tmp)
+		return err
+
+	case ATYP_IPV6:
+		tmp := make([]byte, net.IPv6len+2)
+		copy(tmp, self.IP.To16())
+		binary.BigEndian.PutUint16(tmp[net.IPv6len:], self.Port)
+		_, err := buf.Write(tmp)
+		return err
+
+	case ATYP_DOMAIN:
+		dlen := len(self.Domain)
+		tmp := make([]byte, dlen+2+1)
+		tmp[0] = byte(dlen)
+		copy(tmp[1:], []byte(self.Domain))
+		binary.BigEndian.PutUint16(tmp[1+dlen:], self.Port)
+		_, err := buf.Write(tmp)
+		return err
+
+	default:
+		return ERR_INVALID_ADDR
+	}
+}
+
+type baselineCommandRequest struct {
+	Ver  byte
+	Cmd  byte
+	Rsv  byte
+	Dest baselineAddr
+}
+
+func (self *baselineCommandRequest) Read(r io.Reader) error {
+	tmp := make([]byte, 3)
+	if _, err := io.ReadFull(r, tmp); err != nil {
+		return err
+	}
+	self.Ver = tmp[0]
+	self.Cmd = tmp[1]
+	self.Rsv = tmp[2]
+
+	if self.Ver != VERSION {
+		return ERR_INVALID_VERSION
+	}
+
+	return self.Dest.Read(r)
+}
+
+type baselineCommandReply struct {
+	Ver byte
+	Rep byte
+	Rsv byte
+	Bnd baselineAddr
+}
+
+func (self *baselineCommandReply) Write(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	tmp := make([]byte, 3)
+	tmp[0] = self.Ver
+	tmp[1] = self.Rep
+	tmp[2] = self.Rsv
+	if _, err := buf.Write(tmp); err != nil {
+		return err
+	}
+
+	if err := self.Bnd.Write(buf); err != nil {
+		return err
+	}
+
+	return buf.Flush()
+}
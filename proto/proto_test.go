@@ -0,0 +1,197 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// message is what every SOCKS message of the package implements.
+type message interface {
+	AppendBinary(b []byte) ([]byte, error)
+	Decode(b []byte) (int, error)
+	Read(r io.Reader) error
+}
+
+// testMessages returns one encodable value of every message and a fresh one
+// of the same type to decode into.
+func testMessages() []struct {
+	name    string
+	msg     message
+	decoded func() message
+} {
+	return []struct {
+		name    string
+		msg     message
+		decoded func() message
+	}{
+		{"MethodRequest", &MethodRequest{Ver: VERSION, Methods: []byte{0x00, 0x02}}, func() message { return &MethodRequest{} }},
+		{"MethodReply", &MethodReply{Ver: VERSION, Method: 0x02}, func() message { return &MethodReply{} }},
+		{"CommandRequest/ipv4", &CommandRequest{Ver: VERSION, Cmd: Connect, Dest: NewAddr(net.IPv4(192, 0, 2, 1), 443)}, func() message { return &CommandRequest{} }},
+		{"CommandRequest/ipv6", &CommandRequest{Ver: VERSION, Cmd: Connect, Dest: NewAddr(net.ParseIP("2001:db8::1"), 443)}, func() message { return &CommandRequest{} }},
+		{"CommandRequest/domain", &CommandRequest{Ver: VERSION, Cmd: Connect, Dest: Addr{Type: ATYP_DOMAIN, Domain: "www.example.com", Port: 443}}, func() message { return &CommandRequest{} }},
+		{"CommandReply", &CommandReply{Ver: VERSION, Rep: byte(Success), Bnd: NewAddr(net.IPv4(192, 0, 2, 1), 1080)}, func() message { return &CommandReply{} }},
+		{"UserPasswordRequest", &UserPasswordRequest{Ver: USERPASS_VERSION, Uname: []byte("user"), Passwd: []byte("secret")}, func() message { return &UserPasswordRequest{} }},
+		{"AuthReply", &AuthReply{Ver: USERPASS_VERSION, Status: AuthSuccess}, func() message { return &AuthReply{} }},
+		{"Socks4Request", &Socks4Request{Ver: SOCKS4_VERSION, Cmd: Connect, Port: 80, IP: net.IPv4(192, 0, 2, 1), UserId: "user"}, func() message { return &Socks4Request{} }},
+		{"Socks4Request/4a", &Socks4Request{Ver: SOCKS4_VERSION, Cmd: Connect, Port: 80, UserId: "user", Domain: "www.example.com"}, func() message { return &Socks4Request{} }},
+		{"Socks4Reply", &Socks4Reply{Ver: 0, Code: Socks4Granted, Port: 80, IP: net.IPv4(192, 0, 2, 1)}, func() message { return &Socks4Reply{} }},
+		{"GSSAPIMessage", &GSSAPIMessage{Ver: GSSAPI_VERSION, MTyp: GSSAPIAuthentication, Token: []byte("token")}, func() message { return &GSSAPIMessage{} }},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range testMessages() {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.msg.AppendBinary(nil)
+			if err != nil {
+				t.Fatalf("AppendBinary: %v", err)
+			}
+
+			decoded := tt.decoded()
+			n, err := decoded.Decode(b)
+			if err != nil || n != len(b) {
+				t.Fatalf("Decode = %v, %v, want %v, nil", n, err, len(b))
+			}
+			if again, _ := decoded.AppendBinary(nil); !bytes.Equal(again, b) {
+				t.Fatalf("Decode then AppendBinary = %x, want %x", again, b)
+			}
+
+			// trailing bytes stay in the reader
+			r := bytes.NewReader(append(b, 0xEE))
+			read := tt.decoded()
+			if err := read.Read(r); err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if again, _ := read.AppendBinary(nil); !bytes.Equal(again, b) {
+				t.Fatalf("Read then AppendBinary = %x, want %x", again, b)
+			}
+			if r.Len() != 1 {
+				t.Fatalf("Read left %v bytes, want 1", r.Len())
+			}
+		})
+	}
+}
+
+func TestUDPRequestRoundTrip(t *testing.T) {
+	req := &UDPRequest{Dest: Addr{Type: ATYP_DOMAIN, Domain: "dns.example", Port: 53}, Data: []byte("query")}
+	b, err := req.AppendBinary(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded UDPRequest
+	if _, err := decoded.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Dest.Domain != "dns.example" || decoded.Dest.Port != 53 || string(decoded.Data) != "query" {
+		t.Fatalf("Decode = %+v", decoded)
+	}
+}
+
+// TestNoAllocs holds the codec to its promise: a message value reused for
+// decoding and encoding into a buffer with room does not allocate.
+func TestNoAllocs(t *testing.T) {
+	for _, tt := range testMessages() {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.msg.AppendBinary(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded := tt.decoded()
+			r := bytes.NewReader(b)
+			out := make([]byte, 0, 1024)
+
+			checks := []struct {
+				name string
+				f    func()
+			}{
+				{"Decode", func() { decoded.Decode(b) }},
+				{"Read", func() {
+					r.Reset(b)
+					decoded.Read(r)
+				}},
+				{"AppendBinary", func() { tt.msg.AppendBinary(out[:0]) }},
+			}
+			for _, check := range checks {
+				if allocs := testing.AllocsPerRun(100, check.f); allocs != 0 {
+					t.Errorf("%v allocates %v times", check.name, allocs)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+		b    []byte
+		err  error
+	}{
+		{"MethodRequest/version", &MethodRequest{}, []byte{0x04, 0x01, 0x00}, ERR_INVALID_VERSION},
+		{"MethodRequest/no methods", &MethodRequest{}, []byte{0x05, 0x00}, ERR_INVALID_LENGTH},
+		{"MethodRequest/short", &MethodRequest{}, []byte{0x05, 0x02, 0x00}, ERR_SHORT_BUFFER},
+		{"MethodReply/version", &MethodReply{}, []byte{0x04, 0x00}, ERR_INVALID_VERSION},
+		{"MethodReply/short", &MethodReply{}, []byte{0x05}, ERR_SHORT_BUFFER},
+		{"CommandRequest/version", &CommandRequest{}, []byte{0x04, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80}, ERR_INVALID_VERSION},
+		{"CommandRequest/reserved", &CommandRequest{}, []byte{0x05, 0x01, 0x01, 0x01, 127, 0, 0, 1, 0, 80}, ERR_INVALID_RESERVED},
+		{"CommandRequest/empty domain", &CommandRequest{}, []byte{0x05, 0x01, 0x00, 0x03, 0x00, 0, 80}, ERR_INVALID_ADDR},
+		{"CommandRequest/address type", &CommandRequest{}, []byte{0x05, 0x01, 0x00, 0x02, 127, 0, 0, 1, 0, 80}, ERR_INVALID_ADDR},
+		{"CommandRequest/short header", &CommandRequest{}, []byte{0x05, 0x01}, ERR_SHORT_BUFFER},
+		{"CommandRequest/short address", &CommandRequest{}, []byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0}, ERR_SHORT_BUFFER},
+		{"CommandRequest/short domain", &CommandRequest{}, []byte{0x05, 0x01, 0x00, 0x03, 0x03, 'a', 'b'}, ERR_SHORT_BUFFER},
+		{"CommandReply/version", &CommandReply{}, []byte{0x04, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 80}, ERR_INVALID_VERSION},
+		{"CommandReply/reserved", &CommandReply{}, []byte{0x05, 0x00, 0xFF, 0x01, 127, 0, 0, 1, 0, 80}, ERR_INVALID_RESERVED},
+		{"CommandReply/short", &CommandReply{}, []byte{0x05, 0x00, 0x00, 0x04, 0, 0}, ERR_SHORT_BUFFER},
+		{"UserPasswordRequest/version", &UserPasswordRequest{}, []byte{0x05, 0x01, 'u', 0x01, 'p'}, ERR_INVALID_VERSION},
+		{"UserPasswordRequest/empty user", &UserPasswordRequest{}, []byte{0x01, 0x00, 0x01, 'p'}, ERR_INVALID_LENGTH},
+		{"UserPasswordRequest/empty password", &UserPasswordRequest{}, []byte{0x01, 0x01, 'u', 0x00}, ERR_INVALID_LENGTH},
+		{"UserPasswordRequest/short", &UserPasswordRequest{}, []byte{0x01, 0x01, 'u', 0x02, 'p'}, ERR_SHORT_BUFFER},
+		{"AuthReply/version", &AuthReply{}, []byte{0x05, 0x00}, ERR_INVALID_VERSION},
+		{"Socks4Reply/version", &Socks4Reply{}, []byte{0x04, 0x5A, 0, 80, 127, 0, 0, 1}, ERR_INVALID_VERSION},
+		{"Socks4Reply/short", &Socks4Reply{}, []byte{0x00, 0x5A, 0, 80}, ERR_SHORT_BUFFER},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.msg.Decode(tt.b); !errors.Is(err, tt.err) {
+				t.Errorf("Decode = %v, want %v", err, tt.err)
+			}
+
+			// Read runs out of input where Decode runs out of buffer
+			want := tt.err
+			if want == ERR_SHORT_BUFFER {
+				want = io.ErrUnexpectedEOF
+			}
+			if err := tt.msg.Read(bytes.NewReader(tt.b)); !errors.Is(err, want) {
+				t.Errorf("Read = %v, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestUDPRequestValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"reserved", []byte{0x00, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 53}, ERR_INVALID_RESERVED},
+		{"empty domain", []byte{0x00, 0x00, 0x00, 0x03, 0x00, 0, 53}, ERR_INVALID_ADDR},
+		{"short", []byte{0x00, 0x00, 0x00, 0x01, 127, 0}, ERR_INVALID_PACKET},
+		{"header only", []byte{0x00, 0x00, 0x00}, ERR_INVALID_PACKET},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req UDPRequest
+			if _, err := req.Decode(tt.b); !errors.Is(err, tt.err) {
+				t.Errorf("Decode = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
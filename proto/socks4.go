@@ -0,0 +1,296 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+
+const (
+	SOCKS4_VERSION       byte = 0x04
+	SOCKS4_REPLY_VERSION byte = 0x00
+
+	maxSocks4Field = 255
+)
+
+var (
+	ERR_FIELD_TOO_LONG = errors.New("field too long")
+)
+
+const (
+	Socks4Granted        = byte(90)
+	Socks4Rejected       = byte(91)
+	Socks4NoIdentd       = byte(92)
+	Socks4IdentdMismatch = byte(93)
+)
+
+// SOCKS4 request:
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+// | 1  | 1  |    2    |         4         | variable     | 1  |
+// +----+----+----+----+----+----+----+----+----+----+....+----+
+//
+// SOCKS4a sets DSTIP to 0.0.0.x (x != 0) and appends the domain name
+// terminated by another NULL.
+type Socks4Request struct {
+	Ver    byte
+	Cmd    byte
+	Port   uint16
+	IP     net.IP
+	UserId string
+	Domain string
+
+	ip  [net.IPv4len]byte
+	buf [8 + maxSocks4Field + 1]byte
+}
+
+func (self *Socks4Request) AppendBinary(b []byte) ([]byte, error) {
+	if len(self.UserId) > maxSocks4Field || len(self.Domain) > maxSocks4Field {
+		return b, ERR_FIELD_TOO_LONG
+	}
+
+	b = append(b, self.Ver, self.Cmd)
+	b = binary.BigEndian.AppendUint16(b, self.Port)
+	if self.Domain != "" {
+		b = append(b, 0, 0, 0, 1)
+	} else if ip := self.IP.To4(); ip != nil {
+		b = append(b, ip...)
+	} else {
+		return b, ERR_INVALID_ADDR
+	}
+
+	b = append(b, self.UserId...)
+	b = append(b, 0)
+
+	if self.Domain != "" {
+		b = append(b, self.Domain...)
+		b = append(b, 0)
+	}
+
+	return b, nil
+}
+
+func (self *Socks4Request) Decode(b []byte) (int, error) {
+	if len(b) < 8 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	if err := self.header(b); err != nil {
+		return 0, err
+	}
+	n := 8
+
+	userId, err := nullTerminated(b[n:])
+	if err != nil {
+		return 0, err
+	}
+	setString(&self.UserId, userId)
+	n += len(userId) + 1
+
+	if !self.isSocks4a() {
+		self.Domain = ""
+		return n, nil
+	}
+
+	domain, err := nullTerminated(b[n:])
+	if err != nil {
+		return 0, err
+	}
+	if len(domain) == 0 {
+		return 0, ERR_INVALID_ADDR
+	}
+	setString(&self.Domain, domain)
+
+	return n + len(domain) + 1, nil
+}
+
+func (self *Socks4Request) header(b []byte) error {
+	self.Ver = b[0]
+	if self.Ver != SOCKS4_VERSION {
+		return ERR_INVALID_VERSION
+	}
+	self.Cmd = b[1]
+	self.Port = binary.BigEndian.Uint16(b[2:])
+	self.IP = self.ip[:]
+	copy(self.IP, b[4:8])
+
+	return nil
+}
+
+// isSocks4a reports whether DSTIP is 0.0.0.x with x != 0.
+func (self *Socks4Request) isSocks4a() bool {
+	return self.ip[0] == 0 && self.ip[1] == 0 && self.ip[2] == 0 && self.ip[3] != 0
+}
+
+func (self *Socks4Request) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:8]); err != nil {
+		return err
+	}
+
+	if err := self.header(self.buf[:8]); err != nil {
+		return err
+	}
+
+	userId, err := self.readNullTerminated(r)
+	if err != nil {
+		return err
+	}
+	setString(&self.UserId, userId)
+
+	if !self.isSocks4a() {
+		self.Domain = ""
+		return nil
+	}
+
+	domain, err := self.readNullTerminated(r)
+	if err != nil {
+		return err
+	}
+	if len(domain) == 0 {
+		return ERR_INVALID_ADDR
+	}
+	setString(&self.Domain, domain)
+
+	return nil
+}
+
+func (self *Socks4Request) Write(w io.Writer) error {
+	b, err := self.AppendBinary(self.buf[:0])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// readNullTerminated reads one field into the scratch buffer, the request
+// has no length octets so the field is read byte by byte.
+func (self *Socks4Request) readNullTerminated(r io.Reader) ([]byte, error) {
+	field := self.buf[8:8]
+	for {
+		if _, err := io.ReadFull(r, self.buf[len(self.buf)-1:]); err != nil {
+			return nil, err
+		}
+
+		c := self.buf[len(self.buf)-1]
+		if c == 0 {
+			return field, nil
+		}
+
+		if len(field) == maxSocks4Field {
+			return nil, ERR_FIELD_TOO_LONG
+		}
+		field = append(field, c)
+	}
+}
+
+// Addr returns the destination as a SOCKS5 address.
+func (self *Socks4Request) Addr() Addr {
+	if self.Domain != "" {
+		return Addr{Type: ATYP_DOMAIN, Domain: self.Domain, Port: self.Port}
+	}
+
+	return NewAddr(self.IP, int(self.Port))
+}
+
+func ReadSocks4Request(r io.Reader) (*Socks4Request, error) {
+	req := &Socks4Request{}
+	if err := req.Read(r); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// SOCKS4 reply:
+// +----+----+----+----+----+----+----+----+
+// | VN | CD | DSTPORT |      DSTIP        |
+// +----+----+----+----+----+----+----+----+
+// | 1  | 1  |    2    |         4         |
+// +----+----+----+----+----+----+----+----+
+type Socks4Reply struct {
+	Ver  byte
+	Code byte
+	Port uint16
+	IP   net.IP
+
+	ip  [net.IPv4len]byte
+	buf [8]byte
+}
+
+func (self *Socks4Reply) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, self.Ver, self.Code)
+	b = binary.BigEndian.AppendUint16(b, self.Port)
+	if ip := self.IP.To4(); ip != nil {
+		return append(b, ip...), nil
+	}
+
+	return append(b, 0, 0, 0, 0), nil
+}
+
+func (self *Socks4Reply) Decode(b []byte) (int, error) {
+	if len(b) < 8 {
+		return 0, ERR_SHORT_BUFFER
+	}
+
+	self.Ver = b[0]
+	self.Code = b[1]
+	if self.Ver != SOCKS4_REPLY_VERSION {
+		return 0, ERR_INVALID_VERSION
+	}
+	self.Port = binary.BigEndian.Uint16(b[2:])
+	self.IP = self.ip[:]
+	copy(self.IP, b[4:8])
+
+	return 8, nil
+}
+
+func (self *Socks4Reply) Read(r io.Reader) error {
+	if _, err := io.ReadFull(r, self.buf[:]); err != nil {
+		return err
+	}
+
+	_, err := self.Decode(self.buf[:])
+	return err
+}
+
+func (self *Socks4Reply) Write(w io.Writer) error {
+	b, _ := self.AppendBinary(self.buf[:0])
+	_, err := w.Write(b)
+	return err
+}
+
+func WriteSocks4Reply(w io.Writer, rep *Socks4Reply) error {
+	if rep == nil {
+		return errors.New("rep is invalid")
+	}
+
+	return rep.Write(w)
+}
+
+func nullTerminated(b []byte) ([]byte, error) {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i], nil
+		}
+
+		if i == maxSocks4Field {
+			return nil, ERR_FIELD_TOO_LONG
+		}
+	}
+
+	return nil, ERR_SHORT_BUFFER
+}
+
+// setString stores b in s, copying only when the value changes.
+func setString(s *string, b []byte) {
+	if *s != string(b) {
+		*s = string(b)
+	}
+}
@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ERR_INVALID_PACKET = errors.New("invalid udp packet")
+)
+
+// https://datatracker.ietf.org/doc/html/rfc1928#section-7
+
+// UDP request header:
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+type UDPRequest struct {
+	Rsv  uint16
+	Frag byte
+	Dest Addr
+	// Data aliases the decoded datagram
+	Data []byte
+}
+
+// Len returns the encoded length of the header and data.
+func (self *UDPRequest) Len() int {
+	return 3 + self.Dest.Len() + len(self.Data)
+}
+
+func (self *UDPRequest) AppendBinary(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, self.Rsv)
+	b = append(b, self.Frag)
+
+	b, err := self.Dest.AppendBinary(b)
+	if err != nil {
+		return b, err
+	}
+
+	return append(b, self.Data...), nil
+}
+
+// Decode parses the whole datagram b, Data is the rest of b after the header.
+func (self *UDPRequest) Decode(b []byte) (int, error) {
+	if len(b) < 4 {
+		return 0, ERR_INVALID_PACKET
+	}
+
+	self.Rsv = binary.BigEndian.Uint16(b)
+	self.Frag = b[2]
+	if self.Rsv != 0 {
+		return 0, ERR_INVALID_RESERVED
+	}
+
+	n, err := self.Dest.Decode(b[3:])
+	if err == ERR_SHORT_BUFFER {
+		return 0, ERR_INVALID_PACKET
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	self.Data = b[3+n:]
+	return len(b), nil
+}
+
+func ParseUDPRequest(b []byte) (*UDPRequest, error) {
+	req := &UDPRequest{}
+	if _, err := req.Decode(b); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
@@ -0,0 +1,334 @@
+package resolve
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsFlagResponse  = 1 << 15
+	dnsFlagTruncated = 1 << 9
+	dnsFlagRecursion = 1 << 8
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	dnsHeaderLen = 12
+	maxDNSName   = 255
+	maxDNSLabel  = 63
+
+	defaultDNSTimeout = 5 * time.Second
+)
+
+var (
+	ERR_DNS_INVALID_NAME     = errors.New("invalid dns name")
+	ERR_DNS_INVALID_RESPONSE = errors.New("invalid dns response")
+	ERR_DNS_ID_MISMATCH      = errors.New("dns response id mismatch")
+	ERR_DNS_TRUNCATED        = errors.New("dns response truncated")
+	ERR_DNS_NO_SERVERS       = errors.New("no dns servers configured")
+)
+
+// DNSRcodeError is returned when a server answers with an error code other
+// than NXDOMAIN, the next server is asked.
+type DNSRcodeError struct {
+	Rcode  int
+	Server string
+}
+
+func (self *DNSRcodeError) Error() string {
+	return "dns server " + self.Server + " answered rcode " + strconv.Itoa(self.Rcode)
+}
+
+type DNSOption func(*dnsClient)
+
+// WithTimeout bounds every query to one server, the next server is asked when
+// it expires.
+func WithTimeout(timeout time.Duration) DNSOption {
+	return func(self *dnsClient) {
+		self.timeout = timeout
+	}
+}
+
+// WithNetwork selects the records asked for: "ip4" for A, "ip6" for AAAA and
+// "ip", the default, for both.
+func WithNetwork(network string) DNSOption {
+	return func(self *dnsClient) {
+		self.network = network
+	}
+}
+
+// dnsClient asks A and AAAA queries to a list of servers in order, exchange
+// carries one query to one server.
+type dnsClient struct {
+	servers    []string
+	network    string
+	timeout    time.Duration
+	httpClient *http.Client
+	exchange   func(ctx context.Context, server string, query []byte) ([]byte, error)
+}
+
+func (self *dnsClient) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := self.ResolveTTL(ctx, name)
+	return ips, err
+}
+
+// ResolveTTL asks for the A and AAAA records together, the TTL is the lowest
+// of all records returned.
+func (self *dnsClient) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	// an address is its own answer, like with the system resolver
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	var qtypes []uint16
+	switch self.network {
+	case "ip4":
+		qtypes = []uint16{dnsTypeA}
+	case "ip6":
+		qtypes = []uint16{dnsTypeAAAA}
+	default:
+		qtypes = []uint16{dnsTypeA, dnsTypeAAAA}
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make([]result, len(qtypes))
+
+	wg := sync.WaitGroup{}
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			r := &results[i]
+			r.ips, r.ttl, r.err = self.query(ctx, name, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	for _, r := range results {
+		if r.err != nil {
+			if err == nil || IsNotFound(err) {
+				err = r.err
+			}
+			continue
+		}
+
+		if len(r.ips) > 0 && (len(ips) == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+		ips = append(ips, r.ips...)
+	}
+
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	if err == nil {
+		err = notFound(name, "")
+	}
+
+	return nil, 0, err
+}
+
+func (self *dnsClient) query(ctx context.Context, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(self.servers) == 0 {
+		return nil, 0, ERR_DNS_NO_SERVERS
+	}
+
+	id := newDNSId()
+	query, err := appendDNSQuery(nil, id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := self.timeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+
+	var lastErr error
+	for _, server := range self.servers {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := self.exchange(qctx, server, query)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		ips, ttl, rcode, err := parseDNSResponse(resp, id, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch rcode {
+		case dnsRcodeSuccess:
+			return ips, ttl, nil
+		case dnsRcodeNXDomain:
+			return nil, 0, notFound(name, server)
+		}
+		lastErr = &DNSRcodeError{Rcode: rcode, Server: server}
+	}
+
+	return nil, 0, lastErr
+}
+
+func notFound(name, server string) error {
+	return &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+}
+
+func newDNSId() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// appendDNSQuery appends a recursive query for one record of name.
+func appendDNSQuery(b []byte, id uint16, name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > maxDNSName-2 {
+		return b, ERR_DNS_INVALID_NAME
+	}
+
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, dnsFlagRecursion)
+	// QDCOUNT, ANCOUNT, NSCOUNT, ARCOUNT
+	b = append(b, 0, 1, 0, 0, 0, 0, 0, 0)
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > maxDNSLabel {
+			return b, ERR_DNS_INVALID_NAME
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN), nil
+}
+
+// parseDNSResponse returns the qtype records of the answer section whatever
+// their owner, recursive servers put the CNAME chain before them.
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) ([]net.IP, time.Duration, int, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, 0, 0, ERR_DNS_INVALID_RESPONSE
+	}
+
+	if binary.BigEndian.Uint16(msg) != id {
+		return nil, 0, 0, ERR_DNS_ID_MISMATCH
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&dnsFlagResponse == 0 {
+		return nil, 0, 0, ERR_DNS_INVALID_RESPONSE
+	}
+	if flags&dnsFlagTruncated != 0 {
+		return nil, 0, 0, ERR_DNS_TRUNCATED
+	}
+	rcode := int(flags & 0xF)
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		n, err := skipDNSName(msg, off)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		off = n + 4
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for i := 0; i < ancount; i++ {
+		n, err := skipDNSName(msg, off)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, 0, 0, ERR_DNS_INVALID_RESPONSE
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		rttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, 0, ERR_DNS_INVALID_RESPONSE
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+
+		if rtype != qtype || class != dnsClassIN {
+			continue
+		}
+
+		switch {
+		case rtype == dnsTypeA && rdlen == net.IPv4len,
+			rtype == dnsTypeAAAA && rdlen == net.IPv6len:
+			ips = append(ips, net.IP(append([]byte(nil), rdata...)))
+		default:
+			return nil, 0, 0, ERR_DNS_INVALID_RESPONSE
+		}
+
+		if len(ips) == 1 || rttl < ttl {
+			ttl = rttl
+		}
+	}
+
+	return ips, time.Duration(ttl) * time.Second, rcode, nil
+}
+
+// skipDNSName returns the offset following the name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, ERR_DNS_INVALID_RESPONSE
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xC0 == 0xC0:
+			// a compression pointer ends the name
+			if off+2 > len(msg) {
+				return 0, ERR_DNS_INVALID_RESPONSE
+			}
+			return off + 2, nil
+		case l&0xC0 != 0:
+			return 0, ERR_DNS_INVALID_RESPONSE
+		}
+
+		off += 1 + l
+	}
+}
@@ -0,0 +1,297 @@
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	dnsRcodeServFail = 2
+)
+
+// dnsAnswer answers query with flags, the rcode included, and the ips of the
+// asked record type.
+func dnsAnswer(query []byte, flags uint16, ips ...net.IP) []byte {
+	end, err := skipDNSName(query, dnsHeaderLen)
+	if err != nil {
+		panic(err)
+	}
+	end += 4
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	b := append([]byte(nil), query[:end]...)
+	binary.BigEndian.PutUint16(b[2:], dnsFlagResponse|dnsFlagRecursion|flags)
+
+	ancount := 0
+	for _, ip := range ips {
+		rdata := ip.To4()
+		if qtype == dnsTypeAAAA {
+			if rdata != nil {
+				continue
+			}
+			rdata = ip.To16()
+		} else if rdata == nil {
+			continue
+		}
+
+		// the owner points at the question
+		b = append(b, 0xC0, dnsHeaderLen)
+		b = binary.BigEndian.AppendUint16(b, qtype)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+		b = binary.BigEndian.AppendUint32(b, 60)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+		b = append(b, rdata...)
+		ancount++
+	}
+	binary.BigEndian.PutUint16(b[6:], uint16(ancount))
+
+	return b
+}
+
+// testDNSServer listens on UDP and TCP on the same 127.0.0.1 port. udp returns
+// the datagrams sent back for a query, tcp the response.
+type testDNSServer struct {
+	addr string
+	udp  func(query []byte) [][]byte
+	tcp  func(query []byte) []byte
+
+	udpQueries atomic.Int32
+	tcpQueries atomic.Int32
+}
+
+func newTestDNSServer(t *testing.T, udp func(query []byte) [][]byte, tcp func(query []byte) []byte) *testDNSServer {
+	var pc net.PacketConn
+	var ln net.Listener
+	for i := 0; ln == nil; i++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+
+		// the port may be taken on TCP
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err != nil {
+			pc.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	server := &testDNSServer{addr: pc.LocalAddr().String(), udp: udp, tcp: tcp}
+	go server.serveUDP(pc)
+	go server.serveTCP(ln)
+
+	return server
+}
+
+func (self *testDNSServer) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, maxUDPResponse)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		self.udpQueries.Add(1)
+		for _, resp := range self.udp(buf[:n]) {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (self *testDNSServer) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+
+			self.tcpQueries.Add(1)
+			resp := self.tcp(query)
+			conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+			conn.Write(resp)
+		}()
+	}
+}
+
+func answerWith(flags uint16, ips ...net.IP) func(query []byte) [][]byte {
+	return func(query []byte) [][]byte {
+		return [][]byte{dnsAnswer(query, flags, ips...)}
+	}
+}
+
+func TestDNSTruncatedFallsBackToTCP(t *testing.T) {
+	ip := net.IPv4(192, 0, 2, 1)
+	server := newTestDNSServer(t, answerWith(dnsFlagTruncated), func(query []byte) []byte {
+		return dnsAnswer(query, 0, ip)
+	})
+
+	resolver := NewDNSResolver([]string{server.addr}, WithNetwork("ip4"), WithTimeout(time.Second))
+	ips, ttl, err := resolver.ResolveTTL(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(ip) || ttl != time.Minute {
+		t.Fatalf("ResolveTTL = %v, %v, want [%v], 1m", ips, ttl, ip)
+	}
+
+	if server.udpQueries.Load() != 1 || server.tcpQueries.Load() != 1 {
+		t.Fatalf("udp %v, tcp %v queries, want 1 each", server.udpQueries.Load(), server.tcpQueries.Load())
+	}
+}
+
+func TestDNSServFailAsksNextServer(t *testing.T) {
+	ip := net.IPv4(192, 0, 2, 2)
+	failing := newTestDNSServer(t, answerWith(dnsRcodeServFail), nil)
+	working := newTestDNSServer(t, answerWith(0, ip), nil)
+
+	resolver := NewDNSResolver([]string{failing.addr, working.addr}, WithNetwork("ip4"), WithTimeout(time.Second))
+	ips, err := resolver.Resolve(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Fatalf("Resolve = %v, want [%v]", ips, ip)
+	}
+
+	// with no server left the rcode is reported
+	resolver = NewDNSResolver([]string{failing.addr}, WithNetwork("ip4"), WithTimeout(time.Second))
+	var rcodeErr *DNSRcodeError
+	if _, err := resolver.Resolve(context.Background(), "www.example.com"); !errors.As(err, &rcodeErr) || rcodeErr.Rcode != dnsRcodeServFail {
+		t.Fatalf("Resolve = %v, want rcode %v", err, dnsRcodeServFail)
+	}
+}
+
+func TestDNSNXDomainIsFinal(t *testing.T) {
+	missing := newTestDNSServer(t, answerWith(dnsRcodeNXDomain), nil)
+	other := newTestDNSServer(t, answerWith(0, net.IPv4(192, 0, 2, 3)), nil)
+
+	resolver := NewDNSResolver([]string{missing.addr, other.addr}, WithNetwork("ip4"), WithTimeout(time.Second))
+	if _, err := resolver.Resolve(context.Background(), "missing.example.com"); !IsNotFound(err) {
+		t.Fatalf("Resolve = %v, want not found", err)
+	}
+
+	if n := other.udpQueries.Load(); n != 0 {
+		t.Fatalf("next server asked %v times after NXDOMAIN", n)
+	}
+}
+
+func TestDNSIdMismatch(t *testing.T) {
+	ip := net.IPv4(192, 0, 2, 4)
+	mismatched := func(query []byte) []byte {
+		resp := dnsAnswer(query, 0, ip)
+		resp[0] ^= 0xFF
+		return resp
+	}
+
+	// a stray datagram is skipped, the answer after it is taken
+	server := newTestDNSServer(t, func(query []byte) [][]byte {
+		return [][]byte{mismatched(query), dnsAnswer(query, 0, ip)}
+	}, nil)
+
+	resolver := NewDNSResolver([]string{server.addr}, WithNetwork("ip4"), WithTimeout(time.Second))
+	ips, err := resolver.Resolve(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Fatalf("Resolve = %v, want [%v]", ips, ip)
+	}
+
+	// a stream carries one response, it has to match
+	server = newTestDNSServer(t, answerWith(dnsFlagTruncated), mismatched)
+
+	resolver = NewDNSResolver([]string{server.addr}, WithNetwork("ip4"), WithTimeout(time.Second))
+	if _, err := resolver.Resolve(context.Background(), "www.example.com"); !errors.Is(err, ERR_DNS_ID_MISMATCH) {
+		t.Fatalf("Resolve = %v, want ERR_DNS_ID_MISMATCH", err)
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	ip4 := net.IPv4(192, 0, 2, 5)
+	ip6 := net.ParseIP("2001:db8::5")
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	var queries atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType || len(query) < dnsHeaderLen {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		// RFC 8484 section 4.1 wants the id zero
+		if binary.BigEndian.Uint16(query) != 0 {
+			http.Error(w, "nonzero id", http.StatusBadRequest)
+			return
+		}
+
+		queries.Add(1)
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(dnsAnswer(query, 0, ip4, ip6))
+	}))
+	defer server.Close()
+
+	resolver := NewDoHResolver([]string{broken.URL, server.URL}, WithHTTPClient(server.Client()), WithTimeout(time.Second))
+	ips, err := resolver.Resolve(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found4, found6 bool
+	for _, ip := range ips {
+		found4 = found4 || ip.Equal(ip4)
+		found6 = found6 || ip.Equal(ip6)
+	}
+	if len(ips) != 2 || !found4 || !found6 {
+		t.Fatalf("Resolve = %v, want %v and %v", ips, ip4, ip6)
+	}
+
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("%v queries answered, want A and AAAA", n)
+	}
+}
+
+func TestDNSAddressIsNotQueried(t *testing.T) {
+	server := newTestDNSServer(t, answerWith(dnsRcodeServFail), nil)
+	resolver := NewDNSResolver([]string{server.addr}, WithTimeout(time.Second))
+
+	for _, name := range []string{"10.0.0.1", "2001:db8::1"} {
+		ips, err := resolver.Resolve(context.Background(), name)
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP(name)) {
+			t.Fatalf("Resolve(%v) = %v, %v", name, ips, err)
+		}
+	}
+
+	if n := server.udpQueries.Load(); n != 0 {
+		t.Fatalf("server asked %v times for addresses", n)
+	}
+}
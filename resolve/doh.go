@@ -0,0 +1,75 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc8484
+
+const (
+	dohContentType = "application/dns-message"
+	maxDoHResponse = 64 * 1024
+)
+
+// WithHTTPClient makes DNS over HTTPS use client, http.DefaultClient by
+// default.
+func WithHTTPClient(client *http.Client) DNSOption {
+	return func(self *dnsClient) {
+		self.httpClient = client
+	}
+}
+
+// NewDoHResolver returns a resolver POSTing queries to the DNS over HTTPS
+// endpoints, e.g. "https://dns.example/dns-query", tried in order.
+func NewDoHResolver(urls []string, opts ...DNSOption) TTLResolver {
+	c := &dnsClient{
+		servers:    urls,
+		httpClient: http.DefaultClient,
+	}
+
+	c.exchange = c.exchangeDoH
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+func (self *dnsClient) exchangeDoH(ctx context.Context, url string, query []byte) ([]byte, error) {
+	// the id is zero on DoH so responses can be cached by HTTP caches, it is
+	// put back into the response for matching
+	id := query[:2]
+	query = append([]byte{0, 0}, query[2:]...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server %v answered %v", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) >= 2 && body[0] == 0 && body[1] == 0 {
+		copy(body, id)
+	}
+
+	return body, nil
+}
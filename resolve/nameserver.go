@@ -0,0 +1,112 @@
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+const (
+	// a response without EDNS fits in 512 bytes, larger ones are truncated
+	maxUDPResponse = 512
+)
+
+// NewDNSResolver returns a resolver asking servers over UDP, falling back to
+// TCP for truncated responses. Servers are tried in order, a server is
+// "host" or "host:port", the port defaults to 53.
+func NewDNSResolver(servers []string, opts ...DNSOption) TTLResolver {
+	c := &dnsClient{}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		c.servers = append(c.servers, server)
+	}
+
+	c.exchange = exchangeDNS
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+func exchangeDNS(ctx context.Context, server string, query []byte) ([]byte, error) {
+	resp, err := exchangeUDP(ctx, server, query)
+	if err == ERR_DNS_TRUNCATED {
+		return exchangeTCP(ctx, server, query)
+	}
+
+	return resp, err
+}
+
+func exchangeUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint16(query)
+	buf := make([]byte, maxUDPResponse)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// datagrams not answering this query are ignored
+		if n < dnsHeaderLen || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+
+		if binary.BigEndian.Uint16(buf[2:])&dnsFlagTruncated != 0 {
+			return nil, ERR_DNS_TRUNCATED
+		}
+
+		return buf[:n], nil
+	}
+}
+
+// exchangeTCP sends the query with the two octet length prefix of RFC 1035
+// section 4.2.2.
+func exchangeTCP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	msg = append(msg, query...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
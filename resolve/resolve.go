@@ -3,13 +3,23 @@ package resolve
 import (
 	"context"
 	"net"
-	//"github.com/lkyzhu/socks5/internal/context"
+	"strings"
+	"time"
 )
 
 type Resolver interface {
-	Resolve(ctx context.Context, name string) (net.IP, error)
+	// Resolve returns every address of name, callers must not modify them.
+	Resolve(ctx context.Context, name string) ([]net.IP, error)
 }
 
+// TTLResolver is implemented by resolvers that know how long an answer may
+// be cached, such as ones speaking DNS themselves.
+type TTLResolver interface {
+	Resolver
+	ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error)
+}
+
+// NewResolver returns the system resolver.
 func NewResolver() Resolver {
 	return &resolver{}
 }
@@ -17,11 +27,16 @@ func NewResolver() Resolver {
 type resolver struct {
 }
 
-func (self *resolver) Resolve(ctx context.Context, name string) (net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
-	if err != nil {
-		return nil, err
-	}
+func (self *resolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", name)
+}
+
+// IsNotFound reports whether err says name does not exist.
+func IsNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
 
-	return addr.IP, nil
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
 }
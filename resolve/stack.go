@@ -0,0 +1,210 @@
+package resolve
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheSize   = 1024
+	defaultTTL         = time.Minute
+	defaultNegativeTTL = 10 * time.Second
+)
+
+type Option func(*Stack)
+
+// WithHosts answers the names in hosts without asking the upstream, like
+// /etc/hosts. Names are case insensitive.
+func WithHosts(hosts map[string][]net.IP) Option {
+	return func(self *Stack) {
+		for name, ips := range hosts {
+			self.hosts[normalize(name)] = ips
+		}
+	}
+}
+
+// WithCacheSize bounds the number of cached names, the least recently used
+// one is evicted first. A size of zero disables the cache.
+func WithCacheSize(size int) Option {
+	return func(self *Stack) {
+		self.size = size
+	}
+}
+
+// WithDefaultTTL is how long answers of upstreams that are not TTLResolvers
+// are cached.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(self *Stack) {
+		self.defaultTTL = ttl
+	}
+}
+
+// WithNegativeTTL is how long a name that does not exist is remembered.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(self *Stack) {
+		self.negativeTTL = ttl
+	}
+}
+
+// Stats counts how names were answered.
+type Stats struct {
+	// HostHits are names answered by the hosts map
+	HostHits uint64
+	// Hits are names answered by the cache, NegativeHits the part of them
+	// that were cached as not existing
+	Hits         uint64
+	NegativeHits uint64
+	// Misses are names passed to the upstream
+	Misses uint64
+}
+
+// Stack resolves names through a static hosts map, then an LRU cache, then
+// the upstream resolver.
+type Stack struct {
+	upstream    Resolver
+	hosts       map[string][]net.IP
+	size        int
+	defaultTTL  time.Duration
+	negativeTTL time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   Stats
+}
+
+type cacheEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// NewStack returns a resolver in front of upstream, the system resolver when
+// upstream is nil.
+func NewStack(upstream Resolver, opts ...Option) *Stack {
+	if upstream == nil {
+		upstream = NewResolver()
+	}
+
+	s := &Stack{
+		upstream:    upstream,
+		hosts:       make(map[string][]net.IP),
+		size:        defaultCacheSize,
+		defaultTTL:  defaultTTL,
+		negativeTTL: defaultNegativeTTL,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (self *Stack) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := self.ResolveTTL(ctx, name)
+	return ips, err
+}
+
+// ResolveTTL resolves name and reports how much longer the answer stays
+// cached, so stacks can be layered.
+func (self *Stack) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	name = normalize(name)
+
+	if ips, ok := self.hosts[name]; ok {
+		self.lock.Lock()
+		self.stats.HostHits++
+		self.lock.Unlock()
+		return ips, self.defaultTTL, nil
+	}
+
+	if entry, ok := self.lookup(name); ok {
+		return entry.ips, time.Until(entry.expires), entry.err
+	}
+
+	ips, ttl, err := self.resolveUpstream(ctx, name)
+	if err != nil {
+		if IsNotFound(err) {
+			self.store(name, nil, err, self.negativeTTL)
+		}
+		return nil, 0, err
+	}
+
+	self.store(name, ips, nil, ttl)
+	return ips, ttl, nil
+}
+
+func (self *Stack) resolveUpstream(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if upstream, ok := self.upstream.(TTLResolver); ok {
+		return upstream.ResolveTTL(ctx, name)
+	}
+
+	ips, err := self.upstream.Resolve(ctx, name)
+	return ips, self.defaultTTL, err
+}
+
+// Stats returns the counters since the stack was created.
+func (self *Stack) Stats() Stats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.stats
+}
+
+func (self *Stack) lookup(name string) (*cacheEntry, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	elem, ok := self.entries[name]
+	if ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			self.lru.MoveToFront(elem)
+			self.stats.Hits++
+			if entry.err != nil {
+				self.stats.NegativeHits++
+			}
+			return entry, true
+		}
+
+		self.lru.Remove(elem)
+		delete(self.entries, name)
+	}
+
+	self.stats.Misses++
+	return nil, false
+}
+
+func (self *Stack) store(name string, ips []net.IP, err error, ttl time.Duration) {
+	if self.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entry := &cacheEntry{
+		name:    name,
+		ips:     ips,
+		err:     err,
+		expires: time.Now().Add(ttl),
+	}
+
+	if elem, ok := self.entries[name]; ok {
+		elem.Value = entry
+		self.lru.MoveToFront(elem)
+		return
+	}
+
+	self.entries[name] = self.lru.PushFront(entry)
+	for self.lru.Len() > self.size {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*cacheEntry).name)
+	}
+}
@@ -0,0 +1,232 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver answers from a map and counts the names asked, names missing
+// from the map do not exist.
+type stubResolver struct {
+	lock    sync.Mutex
+	answers map[string][]net.IP
+	asked   map[string]int
+}
+
+func newStubResolver(answers map[string][]net.IP) *stubResolver {
+	return &stubResolver{answers: answers, asked: make(map[string]int)}
+}
+
+func (self *stubResolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.asked[name]++
+	if ips, ok := self.answers[name]; ok {
+		return ips, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (self *stubResolver) count(name string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.asked[name]
+}
+
+// stubTTLResolver answers with a fixed TTL.
+type stubTTLResolver struct {
+	*stubResolver
+	ttl time.Duration
+}
+
+func (self *stubTTLResolver) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	ips, err := self.Resolve(ctx, name)
+	return ips, self.ttl, err
+}
+
+var (
+	stackA = net.IPv4(192, 0, 2, 1)
+	stackB = net.IPv4(192, 0, 2, 2)
+	stackC = net.IPv4(192, 0, 2, 3)
+)
+
+func stackAnswers() map[string][]net.IP {
+	return map[string][]net.IP{
+		"a.example.com": {stackA},
+		"b.example.com": {stackB},
+		"c.example.com": {stackC},
+	}
+}
+
+func TestStack(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		ttl  time.Duration
+		// names resolved in turn, sleeping for pause before each
+		names []string
+		pause time.Duration
+		// how often each name reached the upstream
+		asked map[string]int
+		stats Stats
+	}{
+		{
+			name:  "cached",
+			names: []string{"a.example.com", "A.example.com.", "a.example.com"},
+			asked: map[string]int{"a.example.com": 1},
+			stats: Stats{Hits: 2, Misses: 1},
+		},
+		{
+			name:  "lru eviction",
+			opts:  []Option{WithCacheSize(2)},
+			names: []string{"a.example.com", "b.example.com", "a.example.com", "c.example.com", "a.example.com", "b.example.com"},
+			asked: map[string]int{"a.example.com": 1, "b.example.com": 2, "c.example.com": 1},
+			stats: Stats{Hits: 2, Misses: 4},
+		},
+		{
+			name:  "no cache",
+			opts:  []Option{WithCacheSize(0)},
+			names: []string{"a.example.com", "a.example.com"},
+			asked: map[string]int{"a.example.com": 2},
+			stats: Stats{Misses: 2},
+		},
+		{
+			name:  "default ttl expiry",
+			opts:  []Option{WithDefaultTTL(50 * time.Millisecond)},
+			names: []string{"a.example.com", "a.example.com"},
+			pause: 100 * time.Millisecond,
+			asked: map[string]int{"a.example.com": 2},
+			stats: Stats{Misses: 2},
+		},
+		{
+			name:  "upstream ttl expiry",
+			ttl:   50 * time.Millisecond,
+			names: []string{"a.example.com", "a.example.com"},
+			pause: 100 * time.Millisecond,
+			asked: map[string]int{"a.example.com": 2},
+			stats: Stats{Misses: 2},
+		},
+		{
+			name:  "upstream ttl",
+			ttl:   time.Minute,
+			opts:  []Option{WithDefaultTTL(50 * time.Millisecond)},
+			names: []string{"a.example.com", "a.example.com"},
+			pause: 100 * time.Millisecond,
+			asked: map[string]int{"a.example.com": 1},
+			stats: Stats{Hits: 1, Misses: 1},
+		},
+		{
+			name:  "negative",
+			names: []string{"missing.example.com", "missing.example.com", "missing.example.com"},
+			asked: map[string]int{"missing.example.com": 1},
+			stats: Stats{Hits: 2, NegativeHits: 2, Misses: 1},
+		},
+		{
+			name:  "negative expiry",
+			opts:  []Option{WithNegativeTTL(50 * time.Millisecond)},
+			names: []string{"missing.example.com", "missing.example.com"},
+			pause: 100 * time.Millisecond,
+			asked: map[string]int{"missing.example.com": 2},
+			stats: Stats{Misses: 2},
+		},
+		{
+			name:  "hosts first",
+			opts:  []Option{WithHosts(map[string][]net.IP{"A.Example.com": {stackC}, "local.test": {stackB}})},
+			names: []string{"a.example.com", "local.test.", "b.example.com", "b.example.com"},
+			asked: map[string]int{"b.example.com": 1},
+			stats: Stats{HostHits: 2, Hits: 1, Misses: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubResolver(stackAnswers())
+			var upstream Resolver = stub
+			if tt.ttl > 0 {
+				upstream = &stubTTLResolver{stubResolver: stub, ttl: tt.ttl}
+			}
+			stack := NewStack(upstream, tt.opts...)
+
+			for i, name := range tt.names {
+				if i > 0 {
+					time.Sleep(tt.pause)
+				}
+				if _, err := stack.Resolve(context.Background(), name); err != nil && !IsNotFound(err) {
+					t.Fatalf("Resolve(%v): %v", name, err)
+				}
+			}
+
+			for name, n := range tt.asked {
+				if got := stub.count(name); got != n {
+					t.Errorf("upstream asked %v times for %v, want %v", got, name, n)
+				}
+			}
+			if stats := stack.Stats(); stats != tt.stats {
+				t.Errorf("Stats = %+v, want %+v", stats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestStackAnswers(t *testing.T) {
+	stub := newStubResolver(stackAnswers())
+	stack := NewStack(&stubTTLResolver{stubResolver: stub, ttl: time.Minute},
+		WithHosts(map[string][]net.IP{"a.example.com": {stackC}}), WithDefaultTTL(time.Hour))
+
+	// the hosts map wins over the upstream
+	ips, ttl, err := stack.ResolveTTL(context.Background(), "A.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(stackC) || ttl != time.Hour {
+		t.Fatalf("ResolveTTL = %v, %v, %v, want [%v], 1h", ips, ttl, err, stackC)
+	}
+
+	// a cached answer reports what is left of its ttl
+	if _, _, err := stack.ResolveTTL(context.Background(), "b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	ips, ttl, err = stack.ResolveTTL(context.Background(), "b.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(stackB) || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("cached ResolveTTL = %v, %v, %v, want [%v] within 1m", ips, ttl, err, stackB)
+	}
+
+	// a cached NXDOMAIN is the same error again
+	_, _, first := stack.ResolveTTL(context.Background(), "missing.example.com")
+	_, _, second := stack.ResolveTTL(context.Background(), "missing.example.com")
+	var dnsErr *net.DNSError
+	if !IsNotFound(first) || second != first || !errors.As(second, &dnsErr) || dnsErr.Name != "missing.example.com" {
+		t.Fatalf("ResolveTTL = %v then %v, want the same not found error", first, second)
+	}
+}
+
+func TestStackDoesNotCacheFailures(t *testing.T) {
+	failing := errors.New("upstream unreachable")
+	calls := 0
+	stack := NewStack(resolverFunc(func(ctx context.Context, name string) ([]net.IP, error) {
+		calls++
+		return nil, failing
+	}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := stack.Resolve(context.Background(), "a.example.com"); err != failing {
+			t.Fatalf("Resolve = %v, want %v", err, failing)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("upstream asked %v times, want every time", calls)
+	}
+	if stats := stack.Stats(); stats != (Stats{Misses: 2}) {
+		t.Fatalf("Stats = %+v", stats)
+	}
+}
+
+type resolverFunc func(ctx context.Context, name string) ([]net.IP, error)
+
+func (self resolverFunc) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	return self(ctx, name)
+}
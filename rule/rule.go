@@ -0,0 +1,147 @@
+package rule
+
+import (
+	"net"
+	"strings"
+
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
+)
+
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+)
+
+func (self Action) String() string {
+	switch self {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	}
+
+	return "unknown"
+}
+
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+func (self PortRange) Contains(port uint16) bool {
+	return port >= self.Min && port <= self.Max
+}
+
+// Rule matches a request when every non-empty condition matches. Within one
+// condition any of the listed values may match.
+type Rule struct {
+	Name   string
+	Action Action
+
+	// Commands lists proto.Connect, proto.Bind or proto.Associate
+	Commands []byte
+	// Networks matches the destination ip, resolved domains included
+	Networks []*net.IPNet
+	// Domains matches the requested domain and all of its subdomains
+	Domains []string
+	Ports   []PortRange
+	// Identities matches the name of the authenticated identity
+	Identities []string
+
+	// RemoteResolve keeps the requested domain unresolved and passes it to
+	// the outbound dialer, e.g. an upstream proxy resolving names itself.
+	// Rules are matched on the domain alone for such requests, so Networks
+	// never match them, and BIND can not check who connects back.
+	RemoteResolve bool
+}
+
+func (self *Rule) Match(sess *session.Session, request *proto.CommandRequest) bool {
+	if len(self.Commands) > 0 && !self.matchCommand(request.Cmd) {
+		return false
+	}
+
+	if len(self.Networks) > 0 && !self.matchNetwork(request.Dest.IP) {
+		return false
+	}
+
+	if len(self.Domains) > 0 && !self.matchDomain(request.Dest.Domain) {
+		return false
+	}
+
+	if len(self.Ports) > 0 && !self.matchPort(request.Dest.Port) {
+		return false
+	}
+
+	if len(self.Identities) > 0 && !self.matchIdentity(sess.Identity) {
+		return false
+	}
+
+	return true
+}
+
+func (self *Rule) matchCommand(cmd byte) bool {
+	for _, c := range self.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *Rule) matchNetwork(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range self.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *Rule) matchDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, suffix := range self.Domains {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *Rule) matchPort(port uint16) bool {
+	for _, r := range self.Ports {
+		if r.Contains(port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *Rule) matchIdentity(identity *session.Identity) bool {
+	if identity == nil {
+		return false
+	}
+
+	for _, id := range self.Identities {
+		if id == identity.Name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,35 @@
+package rule
+
+import (
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
+)
+
+type Ruleset interface {
+	// Evaluate returns the rule deciding the request, never nil.
+	Evaluate(sess *session.Session, request *proto.CommandRequest) *Rule
+}
+
+// NewRuleset returns a Ruleset applying the first matching rule in order, or
+// a rule named "default" carrying def when nothing matches.
+func NewRuleset(rules []*Rule, def Action) Ruleset {
+	return &ruleset{
+		rules: rules,
+		def:   &Rule{Name: "default", Action: def},
+	}
+}
+
+type ruleset struct {
+	rules []*Rule
+	def   *Rule
+}
+
+func (self *ruleset) Evaluate(sess *session.Session, request *proto.CommandRequest) *Rule {
+	for _, rule := range self.rules {
+		if rule.Match(sess, request) {
+			return rule
+		}
+	}
+
+	return self.def
+}
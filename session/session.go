@@ -0,0 +1,84 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+
+	"github.com/lkyzhu/socks5/limit"
+	"github.com/sirupsen/logrus"
+)
+
+// Identity describes who authenticated on a session. Name is empty for
+// anonymous methods.
+type Identity struct {
+	Name       string
+	Method     byte
+	Attributes map[string]string
+}
+
+// Advertise is the public address of a listener behind NAT, replies name it
+// in place of the server's local addresses. Host is used when no address of
+// the client's family is set.
+type Advertise struct {
+	IPv4 net.IP
+	IPv6 net.IP
+	Host string
+}
+
+// Session carries the state of one client connection through the
+// authentication and command stages. It is canceled when the connection is
+// done being served.
+type Session struct {
+	Id string
+	// Version is the SOCKS version the client speaks, 4 or 5
+	Version  byte
+	Conn     net.Conn
+	Identity *Identity
+	// TLS is set when the client connected over TLS
+	TLS *tls.ConnectionState
+	// Advertise is set when the listener has a public address configured
+	Advertise *Advertise
+	// Bandwidth is the listener's limit, shared by its sessions
+	Bandwidth *limit.Bandwidth
+	Logger    *logrus.Entry
+	context.Context
+
+	cancel context.CancelFunc
+}
+
+func NewSession(parent context.Context, conn net.Conn) *Session {
+	bytes := make([]byte, 4)
+	rand.Read(bytes)
+	id := hex.EncodeToString(bytes)
+
+	sess := &Session{
+		Id:   id,
+		Conn: conn,
+	}
+
+	sess.Context, sess.cancel = context.WithCancel(parent)
+	sess.Logger = logrus.WithField("id", id)
+	return sess
+}
+
+// SetIdentity records the authenticated identity, every later log line of
+// the session names it.
+func (self *Session) SetIdentity(identity *Identity) {
+	self.Identity = identity
+	if identity == nil {
+		return
+	}
+
+	self.Logger = self.Logger.WithFields(logrus.Fields{
+		"user":   identity.Name,
+		"method": identity.Method,
+	})
+}
+
+// Close cancels the session's context.
+func (self *Session) Close() {
+	self.cancel()
+}
@@ -1,48 +1,556 @@
 package socks5
 
 import (
+	"bufio"
+	sc "context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/lkyzhu/socks5/auth"
 	"github.com/lkyzhu/socks5/command"
-	"github.com/lkyzhu/socks5/internal/context"
-	"github.com/lkyzhu/socks5/internal/proto"
+	"github.com/lkyzhu/socks5/internal/netutil"
+	"github.com/lkyzhu/socks5/limit"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/session"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ERR_SERVER_CLOSED      = errors.New("server closed")
+	ERR_HTTP_NOT_SUPPORTED = errors.New("handler does not serve http")
+)
+
+const (
+	shutdownPollInterval = 50 * time.Millisecond
+	maxAcceptDelay       = time.Second
 )
 
 type Server struct {
-	auth    *auth.AuthenticatorMgr
-	handler command.Handler
+	auth     *auth.AuthenticatorMgr
+	handler  command.Handler
+	sessions *limit.Sessions
+
+	handshakeTimeout time.Duration
+	maxLifetime      time.Duration
+
+	ctx        sc.Context
+	cancel     sc.CancelFunc
+	inShutdown atomic.Bool
+	lock       sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]struct{}
+}
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// WithSessionLimits admits sessions within sessions' limits. Over-limit
+// clients are refused in their protocol: SOCKS5 gets method X'FF' when the
+// client address is over the limit and ServerFailure when the user is,
+// SOCKS4 a rejection and HTTP 503.
+func WithSessionLimits(sessions *limit.Sessions) ServerOption {
+	return func(self *Server) {
+		self.sessions = sessions
+	}
+}
+
+// WithHandshakeTimeout bounds the greeting and authentication of a session,
+// TLS handshake included.
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(self *Server) {
+		self.handshakeTimeout = timeout
+	}
+}
+
+// WithMaxSessionLifetime closes sessions that last longer than lifetime.
+func WithMaxSessionLifetime(lifetime time.Duration) ServerOption {
+	return func(self *Server) {
+		self.maxLifetime = lifetime
+	}
+}
+
+// ListenerOption configures one listener passed to Serve.
+type ListenerOption func(*listenerConfig)
+
+// WithAdvertise makes replies on the listener report advertise instead of the
+// server's local addresses, for servers behind NAT or in containers.
+func WithAdvertise(advertise session.Advertise) ListenerOption {
+	return func(self *listenerConfig) {
+		self.advertise = &advertise
+	}
+}
+
+// WithBandwidth limits the relay of all sessions of the listener together.
+func WithBandwidth(bandwidth *limit.Bandwidth) ListenerOption {
+	return func(self *listenerConfig) {
+		self.bandwidth = bandwidth
+	}
+}
+
+type listenerConfig struct {
+	advertise *session.Advertise
+	bandwidth *limit.Bandwidth
+}
+
+func NewServer(auth *auth.AuthenticatorMgr, handler command.Handler, opts ...ServerOption) *Server {
+	server := &Server{
+		auth:      auth,
+		handler:   handler,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	server.ctx, server.cancel = sc.WithCancel(sc.Background())
+	return server
+}
+
+// ListenAndServe listens on the address and then calls Serve to handle
+// incoming connections. It always returns a non-nil error, after Shutdown
+// the error is ERR_SERVER_CLOSED.
+func (self *Server) ListenAndServe(network, addr string, opts ...ListenerOption) error {
+	if self.inShutdown.Load() {
+		return ERR_SERVER_CLOSED
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	return self.Serve(listener, opts...)
+}
+
+// ListenAndServeTLS is ListenAndServe with every connection wrapped in TLS.
+func (self *Server) ListenAndServeTLS(network, addr string, config *tls.Config, opts ...ListenerOption) error {
+	if self.inShutdown.Load() {
+		return ERR_SERVER_CLOSED
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	return self.ServeTLS(listener, config, opts...)
+}
+
+// ServeTLS serves SOCKS over TLS on the listener. When config asks for client
+// certificates, the verified certificate becomes the session identity.
+func (self *Server) ServeTLS(listener net.Listener, config *tls.Config, opts ...ListenerOption) error {
+	return self.Serve(tls.NewListener(listener, config), opts...)
 }
 
-func NewServer(auth *auth.AuthenticatorMgr, handler command.Handler) *Server {
-	return &Server{
-		auth:    auth,
-		handler: handler,
+// Serve accepts connections on the listener and serves each of them in its
+// own goroutine. The listener is closed when Serve returns.
+func (self *Server) Serve(listener net.Listener, opts ...ListenerOption) error {
+	config := &listenerConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	if !self.trackListener(listener, true) {
+		listener.Close()
+		return ERR_SERVER_CLOSED
+	}
+	defer self.trackListener(listener, false)
+	defer listener.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if self.inShutdown.Load() {
+				return ERR_SERVER_CLOSED
+			}
+
+			if temporaryAccept(err) {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+
+				logrus.WithError(err).Errorf("accept for [%v] fail, retrying in %v", listener.Addr().String(), delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			return err
+		}
+		delay = 0
+
+		go self.serveConn(conn, config)
+	}
+}
+
+// temporaryAccept reports whether a failed accept may work later, like when
+// the process or the system is out of descriptors or a client gave up before
+// it was accepted.
+func temporaryAccept(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// Shutdown stops accepting connections and waits for the active sessions to
+// finish. When ctx expires first the remaining sessions are closed and the
+// context's error is returned.
+func (self *Server) Shutdown(ctx sc.Context) error {
+	self.inShutdown.Store(true)
+
+	self.lock.Lock()
+	var err error
+	for listener := range self.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	self.lock.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if self.activeConns() == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			self.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
 }
 
 func (self *Server) ServeConn(conn net.Conn) error {
+	return self.serveConn(conn, &listenerConfig{})
+}
+
+func (self *Server) serveConn(conn net.Conn, config *listenerConfig) error {
 	defer conn.Close()
 
-	ctx := context.NewContext()
+	if !self.trackConn(conn, true) {
+		return ERR_SERVER_CLOSED
+	}
+	defer self.trackConn(conn, false)
+
+	parent := self.ctx
+	if self.maxLifetime > 0 {
+		var cancel sc.CancelFunc
+		parent, cancel = sc.WithTimeout(parent, self.maxLifetime)
+		defer cancel()
+	}
+
+	sess := session.NewSession(parent, conn)
+	sess.Advertise = config.advertise
+	sess.Bandwidth = config.bandwidth
+	defer sess.Close()
+
+	// an expired or canceled session ends whatever it is blocked in
+	stop := sc.AfterFunc(sess, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if self.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(self.handshakeTimeout))
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := self.handshakeTLS(sess, tlsConn); err != nil {
+			sess.Logger.WithError(err).Errorf("tls handshake fail")
+			return err
+		}
+	}
+
+	// one reader serves every handshake stage, whatever the client pipelined
+	// after the handshake is still in it when the relay starts
+	reader := bufio.NewReader(conn)
+	conn = netutil.NewBufferedConn(conn, reader)
+	sess.Conn = conn
+
+	ver, err := reader.Peek(1)
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("read version fail")
+		return err
+	}
+	sess.Version = ver[0]
+
+	release, err := self.admit(sess, conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	switch sess.Version {
+	case proto.VERSION:
+		err = self.negotiate(sess, conn)
+	case proto.SOCKS4_VERSION:
+		err = self.negotiateSocks4(sess, conn)
+	default:
+		if isHTTPMethod(sess.Version) {
+			return self.serveHTTP(sess, conn, reader)
+		}
+
+		err = proto.ERR_INVALID_VERSION
+	}
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("negotiate version[%v] fail", sess.Version)
+		return err
+	}
+
+	releaseUser, err := self.admitUser(sess, sess.Conn)
+	if err != nil {
+		return err
+	}
+	defer releaseUser()
+
+	if self.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	// command, authenticators may have wrapped the conn
+	err = self.handler.Process(sess, sess.Conn)
+
+	return err
+}
+
+func (self *Server) handshakeTLS(sess *session.Session, conn *tls.Conn) error {
+	if err := conn.HandshakeContext(sess); err != nil {
+		return err
+	}
+
+	state := conn.ConnectionState()
+	sess.TLS = &state
+
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		sess.SetIdentity(&session.Identity{
+			Name:   certName(cert),
+			Method: auth.MethodTLSClientCert,
+			Attributes: map[string]string{
+				"tls.subject": cert.Subject.String(),
+			},
+		})
+	}
+
+	return nil
+}
+
+// certName picks the name a client certificate identifies: the subject common
+// name, else the first DNS or email SAN.
+func certName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
 
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+
+	return ""
+}
+
+func (self *Server) negotiate(sess *session.Session, conn net.Conn) error {
 	// method read
-	method, err := proto.ReadMethodRequest(conn)
+	var method proto.MethodRequest
+	err := method.Read(conn)
 	if err != nil {
-		ctx.Logger.WithError(err).Errorf("read method fail")
+		sess.Logger.WithError(err).Errorf("read method fail")
 		return err
 	}
 
 	// authenticate
-	err = self.auth.Authenticate(ctx, conn, method)
+	err = self.auth.Authenticate(sess, conn, &method)
 	if err != nil {
-		ctx.Logger.WithError(err).Errorf("authenticate fail")
+		sess.Logger.WithError(err).Errorf("authenticate fail")
 		return err
 	}
 
-	ctx.Logger.Debugf("authenticate success")
-	// command
-	err = self.handler.Process(ctx, conn)
+	sess.Logger.Debugf("authenticate success")
+	return nil
+}
 
-	return err
+// negotiateSocks4 admits SOCKS4 clients, which have no way to authenticate,
+// only when the server accepts unauthenticated SOCKS5 clients too.
+func (self *Server) negotiateSocks4(sess *session.Session, conn net.Conn) error {
+	if !self.auth.Supports(auth.MethodNoAuth) {
+		proto.WriteSocks4Reply(conn, &proto.Socks4Reply{Ver: proto.SOCKS4_REPLY_VERSION, Code: proto.Socks4Rejected})
+		return auth.ERR_NO_ACCEPTABLE_METHOD
+	}
+
+	return nil
+}
+
+// serveHTTP serves a client that sent an HTTP request line instead of a
+// SOCKS greeting.
+func (self *Server) serveHTTP(sess *session.Session, conn net.Conn, reader *bufio.Reader) error {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("read http request fail")
+		return err
+	}
+
+	h, ok := self.handler.(command.HTTPHandler)
+	if !ok {
+		fmt.Fprintf(conn, "HTTP/1.1 501 Not Implemented\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return ERR_HTTP_NOT_SUPPORTED
+	}
+
+	identity, err := self.auth.AuthenticateHTTP(sess, req)
+	if err != nil {
+		sess.Logger.WithError(err).Errorf("authenticate http fail")
+		fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"socks5\"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return err
+	}
+	sess.SetIdentity(identity)
+
+	sess.Logger.Debugf("authenticate http success")
+
+	release, err := self.admitUser(sess, conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if self.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	return h.ProcessHTTP(sess, conn, req)
+}
+
+// admit takes a session slot for the client address, over the limit the
+// client is refused before authentication.
+func (self *Server) admit(sess *session.Session, conn net.Conn) (func(), error) {
+	if self.sessions == nil {
+		return func() {}, nil
+	}
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	release, err := self.sessions.Admit(sess, host)
+	if err != nil {
+		sess.Logger.WithError(err).Warnf("refuse client[%v]", host)
+
+		switch sess.Version {
+		case proto.VERSION:
+			// the greeting is read so the refusal answers it
+			if _, rerr := proto.ReadMethodRequest(conn); rerr == nil {
+				proto.WriteMethodReply(conn, &proto.MethodReply{Ver: proto.VERSION, Method: auth.MethodNoAcceptable})
+			}
+		case proto.SOCKS4_VERSION:
+			proto.WriteSocks4Reply(conn, &proto.Socks4Reply{Ver: proto.SOCKS4_REPLY_VERSION, Code: proto.Socks4Rejected})
+		default:
+			writeServiceUnavailable(conn)
+		}
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// admitUser takes a session slot for the authenticated identity, anonymous
+// sessions only count against the client address.
+func (self *Server) admitUser(sess *session.Session, conn net.Conn) (func(), error) {
+	if self.sessions == nil || sess.Identity == nil || sess.Identity.Name == "" {
+		return func() {}, nil
+	}
+
+	release, err := self.sessions.AdmitUser(sess, sess.Identity.Name)
+	if err != nil {
+		sess.Logger.WithError(err).Warnf("refuse user[%v]", sess.Identity.Name)
+
+		switch sess.Version {
+		case proto.VERSION:
+			proto.WriteCommandReply(conn, &proto.CommandReply{Ver: proto.VERSION, Rep: byte(proto.ServerFailure), Bnd: proto.NewAddr(net.IPv4zero, 0)})
+		case proto.SOCKS4_VERSION:
+			proto.WriteSocks4Reply(conn, &proto.Socks4Reply{Ver: proto.SOCKS4_REPLY_VERSION, Code: proto.Socks4Rejected})
+		default:
+			writeServiceUnavailable(conn)
+		}
+		return nil, err
+	}
+
+	return release, nil
+}
+
+func writeServiceUnavailable(conn net.Conn) {
+	fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+}
+
+// isHTTPMethod reports whether b can start an HTTP method token, SOCKS
+// greetings start with a version byte that never can.
+func isHTTPMethod(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+func (self *Server) trackListener(listener net.Listener, add bool) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if add {
+		if self.inShutdown.Load() {
+			return false
+		}
+		self.listeners[listener] = struct{}{}
+	} else {
+		delete(self.listeners, listener)
+	}
+
+	return true
+}
+
+func (self *Server) trackConn(conn net.Conn, add bool) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if add {
+		if self.inShutdown.Load() {
+			return false
+		}
+		self.conns[conn] = struct{}{}
+	} else {
+		delete(self.conns, conn)
+	}
+
+	return true
+}
+
+func (self *Server) activeConns() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return len(self.conns)
+}
+
+func (self *Server) closeConns() {
+	self.cancel()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for conn := range self.conns {
+		conn.Close()
+	}
 }
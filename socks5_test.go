@@ -0,0 +1,216 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lkyzhu/socks5/auth"
+	"github.com/lkyzhu/socks5/client"
+	"github.com/lkyzhu/socks5/command"
+	"github.com/lkyzhu/socks5/proto"
+	"github.com/lkyzhu/socks5/resolve"
+)
+
+// failingListener fails its first accepts with errs.
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (self *failingListener) Accept() (net.Conn, error) {
+	if len(self.errs) > 0 {
+		err := self.errs[0]
+		self.errs = self.errs[1:]
+		return nil, err
+	}
+
+	return self.Listener.Accept()
+}
+
+func acceptError(errno syscall.Errno) error {
+	return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", errno)}
+}
+
+func newTestServer() *Server {
+	authMgr := &auth.AuthenticatorMgr{}
+	authMgr.Regist(auth.NewNoAuthAuthenticator())
+
+	return NewServer(authMgr, command.NewHandler(resolve.NewResolver()))
+}
+
+func TestServeRetriesTemporaryAcceptErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestServer()
+	listener := &failingListener{
+		Listener: ln,
+		errs:     []error{acceptError(syscall.EMFILE), acceptError(syscall.ENFILE), acceptError(syscall.ECONNABORTED)},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	// the listener still serves once the errors are over
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte{proto.VERSION, 0x01, auth.MethodNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	var reply proto.MethodReply
+	if err := reply.Read(conn); err != nil || reply.Method != auth.MethodNoAuth {
+		t.Fatalf("method reply %+v, %v", reply, err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	if err := <-served; err != ERR_SERVER_CLOSED {
+		t.Fatalf("Serve = %v, want ERR_SERVER_CLOSED", err)
+	}
+}
+
+func TestServeStopsOnListenerFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broken := errors.New("listener broken")
+	server := newTestServer()
+	if err := server.Serve(&failingListener{Listener: ln, errs: []error{broken}}); err != broken {
+		t.Fatalf("Serve = %v, want %v", err, broken)
+	}
+}
+
+// testUserPassStore knows one user.
+type testUserPassStore struct {
+	user, passwd string
+}
+
+func (self *testUserPassStore) Create(user, passwd string) error { return nil }
+func (self *testUserPassStore) Update(user, passwd string) error { return nil }
+func (self *testUserPassStore) Delete(user string) error         { return nil }
+
+func (self *testUserPassStore) Validate(user, passwd string) (bool, error) {
+	return user == self.user && passwd == self.passwd, nil
+}
+
+// startEcho serves a destination that sends back what it reads.
+func startEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestPipelinedHandshake(t *testing.T) {
+	echo := startEcho(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authMgr := &auth.AuthenticatorMgr{}
+	authMgr.Regist(auth.NewUserPassAuthenticator(&testUserPassStore{user: "alice", passwd: "secret"}))
+	server := NewServer(authMgr, command.NewHandler(resolve.NewResolver()))
+	go server.Serve(ln)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	// the greeting, the credentials, CONNECT and the payload in one write,
+	// the payload must not stay behind in the handshake's reader
+	var pipelined bytes.Buffer
+	proto.WriteMethodRequest(&pipelined, &proto.MethodRequest{Ver: proto.VERSION, NMethods: 1, Methods: []byte{auth.MethodUserPassword}})
+	proto.WriteUserPasswordRequest(&pipelined, &proto.UserPasswordRequest{
+		Ver:    proto.USERPASS_VERSION,
+		Ulen:   5,
+		Uname:  []byte("alice"),
+		Plen:   6,
+		Passwd: []byte("secret"),
+	})
+	echoAddr := echo.Addr().(*net.TCPAddr)
+	proto.WriteCommandRequest(&pipelined, &proto.CommandRequest{Ver: proto.VERSION, Cmd: proto.Connect, Dest: proto.NewAddr(echoAddr.IP, echoAddr.Port)})
+	payload := []byte("GET / HTTP/1.0\r\n\r\n")
+	pipelined.Write(payload)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(pipelined.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if rep, err := proto.ReadMethodReply(conn); err != nil || rep.Method != auth.MethodUserPassword {
+		t.Fatalf("method reply %+v, %v", rep, err)
+	}
+	if rep, err := proto.ReadAuthReply(conn); err != nil || rep.Status != proto.AuthSuccess {
+		t.Fatalf("auth reply %+v, %v", rep, err)
+	}
+	if rep, err := proto.ReadCommandReply(conn); err != nil || rep.Rep != byte(proto.Success) {
+		t.Fatalf("command reply %+v, %v", rep, err)
+	}
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, echoed); err != nil || !bytes.Equal(echoed, payload) {
+		t.Fatalf("echoed %q, %v, want %q", echoed, err, payload)
+	}
+
+	// the public Dialer goes through the same handshake
+	dialer := client.NewDialer("tcp", ln.Addr().String(), &client.Auth{User: "alice", Password: "secret"})
+	proxied, err := dialer.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxied.Close()
+	proxied.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := proxied.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(proxied, echoed); err != nil || !bytes.Equal(echoed, payload) {
+		t.Fatalf("echoed through the Dialer %q, %v, want %q", echoed, err, payload)
+	}
+
+	// wrong credentials are refused
+	dialer = client.NewDialer("tcp", ln.Addr().String(), &client.Auth{User: "alice", Password: "wrong"})
+	if _, err := dialer.Dial("tcp", echo.Addr().String()); err != client.ERR_AUTH_FAILED {
+		t.Fatalf("Dial = %v, want ERR_AUTH_FAILED", err)
+	}
+}